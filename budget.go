@@ -0,0 +1,49 @@
+package wsproxy
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrSessionBufferFull is reported when connection buffered more than Config.MaxSessionBufferBytes.
+var ErrSessionBufferFull = errors.New("shaxbee/go-wsproxy: session buffer full")
+
+// budget accounts bytes buffered by session across both directions.
+// Methods are safe to call on nil budget.
+type budget struct {
+	mu   sync.Mutex
+	max  int
+	used int
+}
+
+func newBudget(max int) *budget {
+	return &budget{max: max}
+}
+
+// reserve accounts n bytes unless limit would be exceeded.
+func (b *budget) reserve(n int) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.used+n > b.max {
+		return ErrSessionBufferFull
+	}
+	b.used += n
+	return nil
+}
+
+// release returns n bytes reserved before.
+func (b *budget) release(n int) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+}
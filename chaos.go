@@ -0,0 +1,32 @@
+package wsproxy
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// simulate delays message by simulated latency and jitter if Config.ChaosMode is enabled.
+// Returns false if message should be dropped.
+func (s *session) simulate(ctx context.Context) bool {
+	if !s.c.ChaosMode {
+		return true
+	}
+
+	d := s.c.SimulatedLatency
+	if s.c.SimulatedJitter > 0 {
+		d += time.Duration(rand.Int63n(int64(s.c.SimulatedJitter)))
+	}
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	return rand.Float64() >= s.c.SimulatedDropRate
+}
@@ -0,0 +1,78 @@
+package wsproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestSimulatedLatency(t *testing.T) {
+	c := Config{ChaosMode: true, SimulatedLatency: 100 * time.Millisecond, SimulatedJitter: 10 * time.Millisecond}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "foo")
+	})
+	defer ts.Close()
+
+	start := time.Now()
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m string
+	require.NoError(t, websocket.Message.Receive(ws, &m))
+	assert.Equal(t, "foo\n", m)
+	assert.True(t, time.Since(start) >= c.SimulatedLatency, "message not delayed")
+
+	wg.Wait()
+}
+
+func TestSimulatedLatencyMultiplex(t *testing.T) {
+	c := Config{Multiplex: true, ChaosMode: true, SimulatedLatency: 100 * time.Millisecond}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	start := time.Now()
+	require.NoError(t, websocket.Message.Send(ws, EncodeStream(1, []byte("foo"))))
+	require.NoError(t, websocket.Message.Send(ws, EncodeStream(1, nil)))
+
+	var b []byte
+	require.NoError(t, websocket.Message.Receive(ws, &b))
+	assert.Equal(t, EncodeStream(1, []byte("foo\n")), b)
+	// Message is delayed both ways.
+	assert.True(t, time.Since(start) >= 2*c.SimulatedLatency, "message not delayed")
+
+	wg.Wait()
+}
+
+func TestSimulatedDropRate(t *testing.T) {
+	c := Config{ChaosMode: true, SimulatedDropRate: 1}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "foo")
+		fmt.Fprintln(w, "bar")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m string
+	assert.Equal(t, io.EOF, websocket.Message.Receive(ws, &m))
+
+	wg.Wait()
+}
+
+func TestSimulatedDropRateInvalid(t *testing.T) {
+	_, err := NewWithError(Config{ChaosMode: true, SimulatedDropRate: 1.5}, http.NotFoundHandler())
+	assert.Error(t, err)
+}
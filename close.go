@@ -0,0 +1,76 @@
+package wsproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+
+	"golang.org/x/net/websocket"
+)
+
+// Websocket close status codes, see RFC 6455 section 7.4.
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseInternalServerErr       = 1011
+	CloseTryAgainLater           = 1013
+)
+
+// CloseRedirect is a private use close status code sent when backend responds with redirect
+// and Config.HandleRedirects is CloseOnRedirect.
+const CloseRedirect = 4302
+
+// CloseError is returned when websocket is closed by peer with close frame.
+type CloseError struct {
+	// Close status code, CloseNoStatusReceived if none was provided.
+	Code int
+	// Close reason.
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("shaxbee/go-wsproxy: websocket closed with code %d: %s", e.Code, e.Text)
+}
+
+// closeCodec sends close frame with payload encoded by closePayload.
+var closeCodec = websocket.Codec{Marshal: func(v interface{}) ([]byte, byte, error) {
+	return v.([]byte), websocket.CloseFrame, nil
+}}
+
+// pongCodec sends pong frame with payload.
+// x/net/websocket has no API for control frames, frame writer of codec is used instead
+// which depends on websocket.Conn writing frames of any payload type as is.
+var pongCodec = websocket.Codec{Marshal: func(v interface{}) ([]byte, byte, error) {
+	return v.([]byte), websocket.PongFrame, nil
+}}
+
+// validCloseCode reports whether code may be sent in close frame, see RFC 6455 section 7.4.
+func validCloseCode(code int) bool {
+	switch code {
+	case 1004, CloseNoStatusReceived, CloseAbnormalClosure, 1015:
+		return false
+	}
+	return code >= CloseNormalClosure && code < 5000
+}
+
+// closePayload encodes close status code and reason truncated to fit control frame.
+func closePayload(code int, text string) []byte {
+	if len(text) > maxControlPayload-2 {
+		n := maxControlPayload - 2
+		for n > 0 && !utf8.RuneStart(text[n]) {
+			n--
+		}
+		text = text[:n]
+	}
+
+	b := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(b, uint16(code))
+	return append(b, text...)
+}
@@ -0,0 +1,69 @@
+package wsproxy
+
+import (
+	"context"
+	"time"
+)
+
+// coalescer joins consecutive response records into single message, see Config.CoalesceRecords.
+// Batch is sent once it reached max records or Config.CoalesceFlushInterval elapsed since its first record.
+type coalescer struct {
+	max      int
+	interval time.Duration
+	// records read from response, closed once reading failed
+	records chan []byte
+	// error that stopped reading, valid once records is closed
+	err error
+}
+
+func newCoalescer(ctx context.Context, next func() ([]byte, error), max int, interval time.Duration) *coalescer {
+	c := &coalescer{max: max, interval: interval, records: make(chan []byte)}
+	go func() {
+		defer close(c.records)
+		for {
+			rec, err := next()
+			if len(rec) > 0 {
+				select {
+				// Record is only valid until next read.
+				case c.records <- append([]byte(nil), rec...):
+				case <-ctx.Done():
+					c.err = ctx.Err()
+					return
+				}
+			}
+			if err != nil {
+				c.err = err
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// next returns batch of records.
+// Error is returned once buffered records were sent.
+func (c *coalescer) next() ([]byte, error) {
+	var batch []byte
+	var flush <-chan time.Time
+	for n := 0; n < c.max; n++ {
+		select {
+		case rec, ok := <-c.records:
+			if !ok {
+				if len(batch) > 0 {
+					return batch, nil
+				}
+				return nil, c.err
+			}
+			batch = append(batch, rec...)
+		case <-flush:
+			return batch, nil
+		}
+
+		if flush == nil && c.interval > 0 {
+			t := time.NewTimer(c.interval)
+			defer t.Stop()
+			flush = t.C
+		}
+	}
+	return batch, nil
+}
@@ -0,0 +1,41 @@
+package wsproxy
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestCoalesceRecords(t *testing.T) {
+	c := Config{CoalesceRecords: 2, CoalesceFlushInterval: 50 * time.Millisecond}
+	received := make(chan struct{})
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "foo\nbar\nbaz\n")
+		<-received
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m string
+	// size triggered flush
+	require.NoError(t, websocket.Message.Receive(ws, &m))
+	assert.Equal(t, "foo\nbar\n", m)
+
+	// time triggered flush while response is still open
+	start := time.Now()
+	require.NoError(t, ws.SetReadDeadline(time.Now().Add(time.Second)))
+	require.NoError(t, websocket.Message.Receive(ws, &m))
+	assert.Equal(t, "baz\n", m)
+	assert.True(t, time.Since(start) >= 40*time.Millisecond, "Batch flushed before interval elapsed.")
+	close(received)
+
+	wg.Wait()
+}
@@ -0,0 +1,55 @@
+package wsproxy
+
+import (
+	"encoding/json"
+
+	"golang.org/x/net/websocket"
+)
+
+// Conn is a client side websocket connection to WebSocketProxy.
+// Every message is a single JSON record, newline delimiters are handled by proxy.
+type Conn struct {
+	ws *websocket.Conn
+}
+
+// Dial opens websocket connection to WebSocketProxy.
+func Dial(url, origin string) (*Conn, error) {
+	ws, err := websocket.Dial(url, "", origin)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(ws), nil
+}
+
+// NewConn wraps established websocket connection.
+func NewConn(ws *websocket.Conn) *Conn {
+	return &Conn{ws: ws}
+}
+
+// SendToken sends OAuth token as first message, see Config.ReadToken.
+func (c *Conn) SendToken(tok string) error {
+	return websocket.Message.Send(c.ws, tok)
+}
+
+// SendJSON sends v encoded as JSON in a single text frame.
+func (c *Conn) SendJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return websocket.Message.Send(c.ws, string(b))
+}
+
+// ReceiveJSON receives single record and decodes it into v.
+func (c *Conn) ReceiveJSON(v interface{}) error {
+	var b []byte
+	if err := websocket.Message.Receive(c.ws, &b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Close closes websocket connection.
+func (c *Conn) Close() error {
+	return c.ws.Close()
+}
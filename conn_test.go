@@ -0,0 +1,49 @@
+package wsproxy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConn(t *testing.T) {
+	c := Config{ReadToken: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer dummy token", r.Header.Get("Authorization"))
+
+		br := bufio.NewReader(r.Body)
+		bw := bufio.NewWriter(w)
+		for {
+			var m Message
+			if err := read(br, &m); err == io.EOF {
+				return
+			} else if !assert.NoError(t, err) {
+				return
+			}
+			m.Foo += "!"
+			require.NoError(t, write(bw, &m))
+		}
+	})
+	defer ts.Close()
+
+	conn, err := Dial(strings.Replace(ts.URL, "http://", "ws://", 1), ts.URL)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SendToken("dummy token"))
+	for _, foo := range []string{"bar", "baz"} {
+		require.NoError(t, conn.SendJSON(&Message{Foo: foo}))
+
+		var m Message
+		if assert.NoError(t, conn.ReceiveJSON(&m)) {
+			assert.Equal(t, foo+"!", m.Foo)
+		}
+	}
+	require.NoError(t, conn.Close())
+
+	wg.Wait()
+}
@@ -0,0 +1,37 @@
+package wsproxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+)
+
+// decompressor decompresses response declared gzip encoded by backend, see Config.DecompressBackend.
+// Encoding is known once first byte of response is available.
+type decompressor struct {
+	r  *bufio.Reader
+	rf *responseForwarder
+	// response reader, nil until first read
+	zr io.Reader
+}
+
+func newDecompressor(r io.Reader, rf *responseForwarder) *decompressor {
+	return &decompressor{r: bufio.NewReader(r), rf: rf}
+}
+
+func (d *decompressor) Read(p []byte) (int, error) {
+	if d.zr == nil {
+		// Header is written before response body, pipe orders it before read.
+		if _, err := d.r.Peek(1); err != nil {
+			return 0, err
+		}
+		if !d.rf.gzip {
+			d.zr = d.r
+		} else if zr, err := gzip.NewReader(d.r); err != nil {
+			return 0, err
+		} else {
+			d.zr = zr
+		}
+	}
+	return d.zr.Read(p)
+}
@@ -0,0 +1,58 @@
+package wsproxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestDecompressBackend(t *testing.T) {
+	c := Config{DecompressBackend: true}
+	received := make(chan struct{})
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, "foo\n")
+		// record is delivered while response is still open
+		assert.NoError(t, zw.Flush())
+		<-received
+		io.WriteString(zw, "bar\n")
+		zw.Close()
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m string
+	require.NoError(t, websocket.Message.Receive(ws, &m))
+	assert.Equal(t, "foo\n", m)
+	close(received)
+	require.NoError(t, websocket.Message.Receive(ws, &m))
+	assert.Equal(t, "bar\n", m)
+
+	wg.Wait()
+}
+
+func TestDecompressBackendIdentity(t *testing.T) {
+	c := Config{DecompressBackend: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "foo\n")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m string
+	require.NoError(t, websocket.Message.Receive(ws, &m))
+	assert.Equal(t, "foo\n", m)
+
+	wg.Wait()
+}
@@ -0,0 +1,66 @@
+package wsproxy
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrUpgradeFailed is reported when websocket connection could not be established.
+	ErrUpgradeFailed = errors.New("shaxbee/go-wsproxy: upgrade failed")
+	// ErrTokenMissing is reported when token is required but client sent empty one.
+	ErrTokenMissing = errors.New("shaxbee/go-wsproxy: token missing")
+	// ErrTokenRejected is reported when token was rejected by Config.ValidateToken.
+	ErrTokenRejected = errors.New("shaxbee/go-wsproxy: token rejected")
+	// ErrBadAuthEnvelope is reported when first message is not a valid auth envelope.
+	ErrBadAuthEnvelope = errors.New("shaxbee/go-wsproxy: malformed auth envelope")
+	// ErrBackendFailed is reported when backend request could not be created or streamed.
+	ErrBackendFailed = errors.New("shaxbee/go-wsproxy: backend failed")
+	// ErrFrameTypeMismatch is reported when client sent message in unexpected frame type,
+	// see Config.OnFrameTypeMismatch.
+	ErrFrameTypeMismatch = errors.New("shaxbee/go-wsproxy: unexpected frame type")
+	// ErrMethodNotAllowed is reported when backend method is not in Config.AllowedMethods.
+	ErrMethodNotAllowed = errors.New("shaxbee/go-wsproxy: method not allowed")
+	// ErrClientAborted is reported when client connection was reset instead of closed cleanly.
+	ErrClientAborted = errors.New("shaxbee/go-wsproxy: client aborted connection")
+	// ErrTooManyHandlers is reported when backend request exceeds Config.MaxConcurrentHandlers.
+	ErrTooManyHandlers = errors.New("shaxbee/go-wsproxy: too many concurrent handlers")
+	// ErrInvalidUTF8 is reported when text message is not valid UTF-8, see Config.ValidateUTF8.
+	ErrInvalidUTF8 = errors.New("shaxbee/go-wsproxy: invalid UTF-8 in text message")
+	// ErrHookPanic is reported when callback panicked, see Config.HookPanicPolicy.
+	ErrHookPanic = errors.New("shaxbee/go-wsproxy: hook panicked")
+)
+
+// sentinelError annotates err with sentinel so errors.Is matches both.
+type sentinelError struct {
+	sentinel error
+	err      error
+}
+
+func wrapError(sentinel, err error) error {
+	return &sentinelError{sentinel: sentinel, err: err}
+}
+
+func (e *sentinelError) Error() string {
+	return e.sentinel.Error() + ": " + e.err.Error()
+}
+
+func (e *sentinelError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+func (e *sentinelError) Unwrap() error {
+	return e.err
+}
+
+// UpgradeError refuses websocket upgrade with status and body, see Config.BeforeUpgrade.
+type UpgradeError struct {
+	// HTTP status code of response.
+	Status int
+	// Response body.
+	Body string
+}
+
+func (e *UpgradeError) Error() string {
+	return fmt.Sprintf("shaxbee/go-wsproxy: upgrade refused with status %d: %s", e.Status, e.Body)
+}
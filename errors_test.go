@@ -0,0 +1,80 @@
+package wsproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestErrors(t *testing.T) {
+	dummy := errors.New("dummy error")
+
+	for _, tc := range []struct {
+		name     string
+		c        Config
+		h        func(http.ResponseWriter, *http.Request)
+		send     []string
+		expected error
+	}{
+		{
+			name: "upgrade failed",
+			c: Config{ConfigureConn: func(net.Conn) error {
+				return dummy
+			}},
+			expected: ErrUpgradeFailed,
+		},
+		{
+			name:     "token missing",
+			c:        Config{ReadToken: true, RequireToken: true},
+			send:     []string{""},
+			expected: ErrTokenMissing,
+		},
+		{
+			name: "backend failed",
+			c:    Config{LengthPrefixed: true},
+			h: func(w http.ResponseWriter, r *http.Request) {
+				// length prefix of truncated record
+				fmt.Fprint(w, "\x00\x00\x00\x10trunc")
+			},
+			expected: ErrBackendFailed,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			done := make(chan error, 1)
+			tc.c.OnDisconnect = func(r *http.Request, s Stats, err error) {
+				done <- err
+			}
+			h := tc.h
+			if h == nil {
+				h = func(http.ResponseWriter, *http.Request) {}
+			}
+			ts, _ := serve(tc.c, h)
+			defer ts.Close()
+
+			ws := dial(t, ts)
+			defer ws.Close()
+			for _, m := range tc.send {
+				require.NoError(t, websocket.Message.Send(ws, m))
+			}
+
+			err := <-done
+			assert.True(t, errors.Is(err, tc.expected), "Expected %v, got %v.", tc.expected, err)
+		})
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	dummy := errors.New("dummy error")
+	err := wrapError(ErrBackendFailed, dummy)
+
+	assert.True(t, errors.Is(err, ErrBackendFailed))
+	assert.True(t, errors.Is(err, dummy))
+	assert.Equal(t, "shaxbee/go-wsproxy: backend failed: dummy error", err.Error())
+}
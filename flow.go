@@ -0,0 +1,122 @@
+package wsproxy
+
+import (
+	"context"
+	"sync"
+)
+
+// flow buffers messages sent to websocket while paused by client.
+// Methods are safe to call on nil flow.
+type flow struct {
+	mu      sync.Mutex
+	max     int
+	paused  bool
+	resumed chan struct{}
+	// messages buffered while paused and their total size
+	queue [][]byte
+	size  int
+	// accounts buffered messages against session limit
+	budget *budget
+}
+
+func newFlow(max int, b *budget) *flow {
+	return &flow{max: max, budget: b}
+}
+
+// pause buffers subsequent messages until resumed.
+func (f *flow) pause() {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.paused {
+		f.paused = true
+		f.resumed = make(chan struct{})
+	}
+}
+
+// resume sends buffered messages and unblocks writes.
+func (f *flow) resume(send func([]byte) error) error {
+	if f == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.paused {
+		return nil
+	}
+	f.paused = false
+	// Unblock writes only after buffered messages were sent.
+	defer close(f.resumed)
+
+	queue := f.queue
+	f.budget.release(f.size)
+	f.queue, f.size = nil, 0
+	for _, m := range queue {
+		if err := send(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write sends m unless paused.
+// While paused m is buffered if it fits within limits,
+// otherwise write blocks until resumed or ctx is done.
+// Returns ErrSessionBufferFull if buffering m exceeds session limit.
+func (f *flow) write(ctx context.Context, m []byte, send func([]byte) error) error {
+	if f == nil {
+		return send(m)
+	}
+
+	for {
+		f.mu.Lock()
+		if !f.paused {
+			err := send(m)
+			f.mu.Unlock()
+			return err
+		}
+		if f.size+len(m) <= f.max {
+			if err := f.budget.reserve(len(m)); err != nil {
+				f.mu.Unlock()
+				return err
+			}
+			f.queue = append(f.queue, append([]byte(nil), m...))
+			f.size += len(m)
+			f.mu.Unlock()
+			return nil
+		}
+		resumed := f.resumed
+		f.mu.Unlock()
+
+		// Buffer is full, block backend until resumed.
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// wait blocks until resumed or ctx is done.
+func (f *flow) wait(ctx context.Context) {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	paused, resumed := f.paused, f.resumed
+	f.mu.Unlock()
+
+	if paused {
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package wsproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+)
+
+// flushReader splits response into delimited records.
+// Partial record is returned once it was buffered for Config.FlushInterval.
+type flushReader struct {
+	delim    []byte
+	interval time.Duration
+	// chunks read from response, closed once reading failed
+	data chan []byte
+	// error that stopped reading, valid once data is closed
+	err error
+	// pending data not returned yet
+	buf []byte
+}
+
+func newFlushReader(ctx context.Context, r io.Reader, delim []byte, interval time.Duration) *flushReader {
+	fr := &flushReader{delim: delim, interval: interval, data: make(chan []byte)}
+	go func() {
+		defer close(fr.data)
+		for {
+			b := make([]byte, 4096)
+			n, err := r.Read(b)
+			if n > 0 {
+				select {
+				case fr.data <- b[:n]:
+				case <-ctx.Done():
+					fr.err = ctx.Err()
+					return
+				}
+			}
+			if err != nil {
+				fr.err = err
+				return
+			}
+		}
+	}()
+	return fr
+}
+
+// next returns next record including delimiter or partial record buffered for flush interval.
+// Final record is returned along with io.EOF like readLine.
+func (fr *flushReader) next() ([]byte, error) {
+	var flush <-chan time.Time
+	for {
+		if i := bytes.Index(fr.buf, fr.delim); i >= 0 {
+			n := i + len(fr.delim)
+			rec := fr.buf[:n:n]
+			fr.buf = fr.buf[n:]
+			return rec, nil
+		}
+		if len(fr.buf) > 0 && flush == nil {
+			t := time.NewTimer(fr.interval)
+			defer t.Stop()
+			flush = t.C
+		}
+
+		select {
+		case b, ok := <-fr.data:
+			if !ok {
+				rec := fr.buf
+				fr.buf = nil
+				return rec, fr.err
+			}
+			fr.buf = append(fr.buf, b...)
+		case <-flush:
+			rec := fr.buf
+			fr.buf = nil
+			return rec, nil
+		}
+	}
+}
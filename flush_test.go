@@ -0,0 +1,141 @@
+package wsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestFlushInterval(t *testing.T) {
+	c := Config{FlushInterval: 20 * time.Millisecond}
+	received := make(chan struct{})
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "foo\npartial")
+		<-received
+		io.WriteString(w, " record\n")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	for _, exp := range []string{"foo\n", "partial"} {
+		var m string
+		require.NoError(t, ws.SetReadDeadline(time.Now().Add(time.Second)))
+		if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+			assert.Equal(t, exp, m)
+		}
+	}
+	close(received)
+
+	var m string
+	if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+		assert.Equal(t, " record\n", m)
+	}
+
+	wg.Wait()
+}
+
+// holdConn buffers writes while held, sending messages back to back.
+type holdConn struct {
+	net.Conn
+	held *bytes.Buffer
+}
+
+func (c *holdConn) Write(b []byte) (int, error) {
+	if c.held != nil {
+		return c.held.Write(b)
+	}
+	return c.Conn.Write(b)
+}
+
+func TestFlushEachInboundFrame(t *testing.T) {
+	for _, each := range []bool{true, false} {
+		exp := "foo\nbar\n"
+		if each {
+			exp = "foo\n"
+		}
+		done := make(chan struct{})
+		c := Config{FlushEachInboundFrame: each, OnDisconnect: func(*http.Request, Stats, error) { close(done) }}
+		ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+			b := make([]byte, 64)
+			n, err := r.Body.Read(b)
+			if assert.NoError(t, err) {
+				assert.Equal(t, exp, string(b[:n]))
+			}
+		})
+		defer ts.Close()
+
+		conf, err := websocket.NewConfig(strings.Replace(ts.URL, "http://", "ws://", 1), ts.URL)
+		require.NoError(t, err)
+		conn, err := net.Dial("tcp", conf.Location.Host)
+		require.NoError(t, err)
+		hc := &holdConn{Conn: conn}
+		ws, err := websocket.NewClient(conf, hc)
+		require.NoError(t, err)
+		defer ws.Close()
+
+		hc.held = &bytes.Buffer{}
+		require.NoError(t, websocket.Message.Send(ws, "foo"))
+		require.NoError(t, websocket.Message.Send(ws, "bar"))
+		_, err = conn.Write(hc.held.Bytes())
+		require.NoError(t, err)
+
+		wg.Wait()
+		ws.Close()
+		<-done
+	}
+}
+
+// BenchmarkInboundFlush measures forwarding of 64 byte messages to request body
+// flushed after every message and batched.
+func BenchmarkInboundFlush(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		each bool
+	}{
+		{name: "each", each: true},
+		{name: "batched", each: false},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			received := make(chan struct{})
+			ts := httptest.NewServer(New(Config{FlushEachInboundFrame: bc.each}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				br := bufio.NewReader(r.Body)
+				for i := 0; i < b.N; i++ {
+					if _, err := br.ReadSlice('\n'); err != nil {
+						b.Error(err)
+						break
+					}
+				}
+				close(received)
+			})))
+			defer ts.Close()
+
+			ws, err := websocket.Dial(strings.Replace(ts.URL, "http://", "ws://", 1), "", ts.URL)
+			require.NoError(b, err)
+			defer ws.Close()
+
+			payload := []byte(strings.Repeat("x", 63))
+			b.SetBytes(int64(len(payload) + 1))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := ws.Write(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			<-received
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package wsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/net/websocket"
+)
+
+// ErrTooManyFragments is returned when message consists of more frames than Config.MaxFragments.
+var ErrTooManyFragments = errors.New("shaxbee/go-wsproxy: too many message fragments")
+
+// receive reads single message from websocket reassembling fragmented frames.
+// Returns *CloseError if close frame is received.
+// Message is read into buf which is reset first, returned message is valid until buf is modified.
+// Total size of message is limited by ws.MaxPayloadBytes.
+// Fragment count is limited by maxFragments unless zero.
+func receive(ws *websocket.Conn, buf *bytes.Buffer, maxFragments int) (payloadType byte, msg []byte, err error) {
+	maxPayloadBytes := ws.MaxPayloadBytes
+	if maxPayloadBytes == 0 {
+		maxPayloadBytes = websocket.DefaultMaxPayloadBytes
+	}
+
+	buf.Reset()
+	fragments := 0
+	for {
+		frame, err := ws.NewFrameReader()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// FIN bit is only exposed through raw frame header
+		fin := true
+		if hr := frame.HeaderReader(); hr != nil {
+			var b [1]byte
+			if _, err := io.ReadFull(hr, b[:]); err != nil {
+				return 0, nil, err
+			}
+			fin = b[0]&0x80 != 0
+		}
+
+		raw := frame
+		frame, err = ws.HandleFrame(frame)
+		if err == io.EOF && raw.PayloadType() == websocket.CloseFrame {
+			return 0, nil, readClose(raw)
+		} else if err != nil {
+			return 0, nil, err
+		}
+		if frame == nil {
+			// control frame
+			continue
+		}
+
+		fragments++
+		if maxFragments > 0 && fragments > maxFragments {
+			return 0, nil, ErrTooManyFragments
+		}
+		if fragments == 1 {
+			payloadType = frame.PayloadType()
+		}
+
+		// read one byte past limit to detect oversized message
+		if _, err := buf.ReadFrom(io.LimitReader(frame, int64(maxPayloadBytes-buf.Len()+1))); err != nil {
+			return 0, nil, err
+		}
+		if buf.Len() > maxPayloadBytes {
+			return 0, nil, websocket.ErrFrameTooLarge
+		}
+
+		if fin {
+			return payloadType, buf.Bytes(), nil
+		}
+	}
+}
+
+// readLine reads until delim like bufio.Reader.ReadBytes.
+// Returned slice is only valid until next read unless line exceeds buffer of r.
+func readLine(r *bufio.Reader, delim byte) ([]byte, error) {
+	line, err := r.ReadSlice(delim)
+	if err != bufio.ErrBufferFull {
+		return line, err
+	}
+
+	// line exceeds buffer
+	b := append([]byte(nil), line...)
+	for err == bufio.ErrBufferFull {
+		line, err = r.ReadSlice(delim)
+		b = append(b, line...)
+	}
+	return b, err
+}
+
+// readDelimited reads until delim consisting of one or more bytes.
+// Returned slice is only valid until next read like readLine.
+func readDelimited(r *bufio.Reader, delim []byte) ([]byte, error) {
+	last := delim[len(delim)-1]
+	line, err := readLine(r, last)
+	if err != nil || len(delim) == 1 || bytes.HasSuffix(line, delim) {
+		return line, err
+	}
+
+	// last byte of delimiter is part of record
+	b := append([]byte(nil), line...)
+	for {
+		line, err = readLine(r, last)
+		b = append(b, line...)
+		if err != nil || bytes.HasSuffix(b, delim) {
+			return b, err
+		}
+	}
+}
+
+// splitReader splits response into records with bufio.SplitFunc, see Config.SplitFunc.
+type splitReader struct {
+	sc *bufio.Scanner
+}
+
+func newSplitReader(r io.Reader, split bufio.SplitFunc) *splitReader {
+	sc := bufio.NewScanner(r)
+	sc.Split(split)
+	return &splitReader{sc: sc}
+}
+
+// next returns record split from response.
+// Returned slice is only valid until next call.
+func (sr *splitReader) next() ([]byte, error) {
+	if sr.sc.Scan() {
+		return sr.sc.Bytes(), nil
+	}
+	if err := sr.sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// ErrBadJSON is returned when response is not a stream of JSON values, see Config.JSONAwareFraming.
+var ErrBadJSON = errors.New("shaxbee/go-wsproxy: invalid JSON value")
+
+// readJSON reads single JSON value skipping leading whitespace.
+// Objects, arrays and strings may contain newlines, other values must be followed by whitespace.
+// Value is checked with valid.
+func readJSON(r *bufio.Reader, valid func([]byte) bool) ([]byte, error) {
+	c, err := r.ReadByte()
+	for err == nil && isSpace(c) {
+		c, err = r.ReadByte()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b := []byte{c}
+	switch c {
+	case '{', '[', '"':
+		// nesting depth of objects and arrays
+		depth := 0
+		if c != '"' {
+			depth = 1
+		}
+		str := c == '"'
+		escaped := false
+		for depth > 0 || str {
+			if c, err = r.ReadByte(); err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			} else if err != nil {
+				return nil, err
+			}
+			b = append(b, c)
+
+			switch {
+			case escaped:
+				escaped = false
+			case str && c == '\\':
+				escaped = true
+			case c == '"':
+				str = !str
+			case str:
+			case c == '{' || c == '[':
+				depth++
+			case c == '}' || c == ']':
+				depth--
+			}
+		}
+	default:
+		for {
+			if c, err = r.ReadByte(); err != nil || isSpace(c) {
+				break
+			}
+			b = append(b, c)
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	if !valid(b) {
+		return nil, ErrBadJSON
+	}
+	return b, err
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// readClose reads close frame payload.
+func readClose(frame io.Reader) error {
+	b, err := ioutil.ReadAll(io.LimitReader(frame, maxControlPayload))
+	if err != nil {
+		return err
+	}
+
+	ce := &CloseError{Code: CloseNoStatusReceived}
+	if len(b) >= 2 {
+		ce.Code = int(binary.BigEndian.Uint16(b))
+		ce.Text = string(b[2:])
+	}
+	return ce
+}
+
+const maxControlPayload = 125
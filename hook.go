@@ -0,0 +1,43 @@
+package wsproxy
+
+import "fmt"
+
+// HookPanicPolicy defines handling of panics in callbacks provided through Config.
+type HookPanicPolicy int
+
+const (
+	// PropagateHookPanic leaves panics unrecovered.
+	PropagateHookPanic HookPanicPolicy = iota
+	// CloseOnHookPanic logs panic and closes websocket with CloseInternalServerErr.
+	// Callbacks invoked outside of websocket session are treated as unset.
+	CloseOnHookPanic
+	// ContinueOnHookPanic logs panic and continues as if callback was unset.
+	ContinueOnHookPanic
+)
+
+// hook invokes callback f named name recovering panics according to HookPanicPolicy.
+// Session s is closed on panic unless nil.
+// Returns false if f panicked.
+func (c *Config) hook(s *session, name string, f func()) (ok bool) {
+	if c.HookPanicPolicy == PropagateHookPanic {
+		f()
+		return true
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false
+			if s == nil {
+				logger.Errorf("shaxbee/go-wsproxy: Panic in %s: %v", name, r)
+				return
+			}
+			s.log.Errorf("shaxbee/go-wsproxy: Panic in %s: %v", name, r)
+			if c.HookPanicPolicy == CloseOnHookPanic {
+				s.abort(CloseInternalServerErr, closeReasonError, wrapError(ErrHookPanic, fmt.Errorf("%s: %v", name, r)))
+			}
+		}
+	}()
+
+	f()
+	return true
+}
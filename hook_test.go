@@ -0,0 +1,65 @@
+package wsproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseOnHookPanic(t *testing.T) {
+	_, restore := captureLogger()
+	defer restore()
+
+	done := make(chan error, 1)
+	c := Config{
+		HookPanicPolicy: CloseOnHookPanic,
+		ReadToken:       true,
+		ConnectionLabels: func(*http.Request) map[string]string {
+			panic("dummy panic")
+		},
+		OnDisconnect: func(r *http.Request, s Stats, err error) { done <- err },
+	}
+	ts := httptest.NewServer(New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler invoked.")
+	})))
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	assert.Equal(t, CloseInternalServerErr, receiveClose(t, ws))
+	assert.True(t, errors.Is(<-done, ErrHookPanic))
+}
+
+func TestContinueOnHookPanic(t *testing.T) {
+	l, restore := captureLogger()
+	defer restore()
+
+	done := make(chan struct{})
+	c := Config{
+		HookPanicPolicy: ContinueOnHookPanic,
+		ConnectionLabels: func(*http.Request) map[string]string {
+			panic("dummy panic")
+		},
+		OnDisconnect: func(*http.Request, Stats, error) {
+			close(done)
+			panic("dummy panic")
+		},
+	}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	assert.Equal(t, CloseNormalClosure, receiveClose(t, ws))
+	wg.Wait()
+	<-done
+
+	assert.Eventually(t, func() bool { return len(l.Errors()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "shaxbee/go-wsproxy: Panic in ConnectionLabels: dummy panic", l.Errors()[0])
+}
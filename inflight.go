@@ -0,0 +1,93 @@
+package wsproxy
+
+import "context"
+
+// inflight accounts response messages read from backend but not sent to websocket yet,
+// see Config.MaxFramesInFlight. Methods are safe to call on nil inflight.
+type inflight struct {
+	slots chan struct{}
+}
+
+func newInflight(max int) *inflight {
+	return &inflight{slots: make(chan struct{}, max)}
+}
+
+// acquire blocks until message may be read or ctx is done.
+func (f *inflight) acquire(ctx context.Context) error {
+	if f == nil {
+		return nil
+	}
+
+	select {
+	case f.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees slot of message sent or discarded.
+func (f *inflight) release() {
+	if f == nil {
+		return
+	}
+
+	select {
+	case <-f.slots:
+	default:
+	}
+}
+
+// prefetcher reads response records ahead of writes to websocket.
+// Record is read only once slot was acquired, blocking backend once limit is reached.
+type prefetcher struct {
+	// records read from response, closed once reading failed
+	records chan prefetched
+	// error that stopped reading, valid once records is closed
+	err error
+}
+
+type prefetched struct {
+	rec []byte
+	err error
+}
+
+func newPrefetcher(ctx context.Context, next func() ([]byte, error), f *inflight) *prefetcher {
+	p := &prefetcher{records: make(chan prefetched, cap(f.slots))}
+	go func() {
+		defer close(p.records)
+		for {
+			if err := f.acquire(ctx); err != nil {
+				p.err = err
+				return
+			}
+			rec, err := next()
+			if len(rec) == 0 {
+				f.release()
+			}
+
+			select {
+			// Record is only valid until next read.
+			case p.records <- prefetched{rec: append([]byte(nil), rec...), err: err}:
+			case <-ctx.Done():
+				p.err = ctx.Err()
+				return
+			}
+			// Invalid JSON record may be skipped, see Config.ErrorPolicy.
+			if err != nil && err != ErrBadJSON {
+				p.err = err
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// next returns record read ahead along with error of read.
+func (p *prefetcher) next() ([]byte, error) {
+	r, ok := <-p.records
+	if !ok {
+		return nil, p.err
+	}
+	return r.rec, r.err
+}
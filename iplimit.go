@@ -0,0 +1,38 @@
+package wsproxy
+
+import (
+	"net"
+	"net/http"
+)
+
+// clientIP returns host part of remote address of r.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// acquireIP registers connection from ip.
+// Returns false if ip reached Config.MaxConnectionsPerIP.
+func (wp *WebSocketProxy) acquireIP(ip string) bool {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	if wp.perIP[ip] >= wp.c.MaxConnectionsPerIP {
+		return false
+	}
+	wp.perIP[ip]++
+	return true
+}
+
+// releaseIP unregisters connection from ip forgetting ip once it has no connections.
+func (wp *WebSocketProxy) releaseIP(ip string) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	if wp.perIP[ip]--; wp.perIP[ip] <= 0 {
+		delete(wp.perIP, ip)
+	}
+}
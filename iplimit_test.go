@@ -0,0 +1,40 @@
+package wsproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	c := Config{MaxConnectionsPerIP: 2}
+	wp := New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	ts := httptest.NewServer(wp)
+	defer ts.Close()
+
+	ws1 := dial(t, ts)
+	ws2 := dial(t, ts)
+
+	r := handshake(t, ts, nil)
+	r.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, r.StatusCode)
+
+	ws1.Close()
+	ws2.Close()
+	assert.Eventually(t, func() bool {
+		wp.mu.Lock()
+		defer wp.mu.Unlock()
+
+		return len(wp.perIP) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	ws := dial(t, ts)
+	ws.Close()
+}
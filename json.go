@@ -0,0 +1,28 @@
+package wsproxy
+
+import "encoding/json"
+
+// JSONCodec encodes and decodes JSON messages handled by proxy.
+type JSONCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	Valid(data []byte) bool
+}
+
+// StdJSONCodec is a JSONCodec backed by encoding/json.
+type StdJSONCodec struct{}
+
+// Marshal calls json.Marshal.
+func (StdJSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal calls json.Unmarshal.
+func (StdJSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Valid calls json.Valid.
+func (StdJSONCodec) Valid(data []byte) bool {
+	return json.Valid(data)
+}
@@ -0,0 +1,85 @@
+package wsproxy
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"golang.org/x/net/websocket"
+)
+
+type countingCodec struct {
+	StdJSONCodec
+	marshaled int32
+	validated int32
+}
+
+func (c *countingCodec) Marshal(v interface{}) ([]byte, error) {
+	atomic.AddInt32(&c.marshaled, 1)
+	return c.StdJSONCodec.Marshal(v)
+}
+
+func (c *countingCodec) Valid(data []byte) bool {
+	atomic.AddInt32(&c.validated, 1)
+	return c.StdJSONCodec.Valid(data)
+}
+
+func TestJSONCodec(t *testing.T) {
+	codec := &countingCodec{}
+	c := Config{SendSessionSummary: true, JSONCodec: codec}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+	wg.Wait()
+
+	var s struct {
+		Summary Stats `json:"summary"`
+	}
+	if assert.NoError(t, websocket.JSON.Receive(ws, &s)) {
+		assert.Equal(t, closeReasonBackend, s.Summary.CloseReason)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&codec.marshaled))
+}
+
+func TestJSONCodecValid(t *testing.T) {
+	codec := &countingCodec{}
+	c := Config{JSONAwareFraming: true, JSONCodec: codec}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"foo": "bar"}`)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m string
+	if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+		assert.Equal(t, `{"foo": "bar"}`, m)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&codec.validated))
+}
+
+func TestJSONCodecMetadata(t *testing.T) {
+	codec := &countingCodec{}
+	c := Config{FirstLineIsMetadata: true, JSONCodec: codec}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "{\"stream\": \"foo\"}\n")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m string
+	if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+		assert.JSONEq(t, `{"metadata": {"stream": "foo"}}`, m)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&codec.validated))
+}
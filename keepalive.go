@@ -0,0 +1,60 @@
+package wsproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// keepalive invokes send whenever no activity was reported for duration.
+// Methods are safe to call on nil keepalive.
+type keepalive struct {
+	mu      sync.Mutex
+	d       time.Duration
+	t       *time.Timer
+	stopped bool
+	send    func()
+}
+
+func newKeepalive(d time.Duration, send func()) *keepalive {
+	k := &keepalive{d: d, send: send}
+	k.t = time.AfterFunc(d, k.fire)
+	return k
+}
+
+func (k *keepalive) fire() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.stopped {
+		return
+	}
+	k.send()
+	k.t.Reset(k.d)
+}
+
+// reset postpones keepalive after activity.
+func (k *keepalive) reset() {
+	if k == nil {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.stopped {
+		k.t.Reset(k.d)
+	}
+}
+
+// stop prevents further keepalives, waiting for keepalive in progress.
+func (k *keepalive) stop() {
+	if k == nil {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.stopped = true
+	k.t.Stop()
+}
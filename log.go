@@ -0,0 +1,70 @@
+package wsproxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Logger receives diagnostic messages from WebSocketProxy.
+// Messages are discarded unless logger is set using SetLogger
+// or package is built with glog tag.
+type Logger interface {
+	Errorf(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+}
+
+var logger Logger = nopLogger{}
+
+// SetLogger sets logger used by all WebSocketProxy instances.
+// Passing nil discards all messages.
+// Must be called before serving any requests.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	logger = l
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Errorf(string, ...interface{})   {}
+func (nopLogger) Warningf(string, ...interface{}) {}
+func (nopLogger) Debugf(string, ...interface{})   {}
+
+// labeledLogger appends connection labels to messages passed to logger.
+type labeledLogger struct {
+	// labels formatted as " [key=value ...]", escaped for use in format string
+	suffix string
+}
+
+func newLabeledLogger(labels map[string]string) labeledLogger {
+	if len(labels) == 0 {
+		return labeledLogger{}
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%s", k, labels[k])
+	}
+	return labeledLogger{suffix: strings.ReplaceAll(" ["+strings.Join(parts, " ")+"]", "%", "%%")}
+}
+
+func (l labeledLogger) Errorf(format string, args ...interface{}) {
+	logger.Errorf(format+l.suffix, args...)
+}
+
+func (l labeledLogger) Warningf(format string, args ...interface{}) {
+	logger.Warningf(format+l.suffix, args...)
+}
+
+func (l labeledLogger) Debugf(format string, args ...interface{}) {
+	logger.Debugf(format+l.suffix, args...)
+}
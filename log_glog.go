@@ -0,0 +1,29 @@
+//go:build glog
+// +build glog
+
+package wsproxy
+
+import "github.com/golang/glog"
+
+func init() {
+	SetLogger(GlogLogger{})
+}
+
+// GlogLogger forwards messages to glog.
+// Debug messages are logged at verbosity level 2.
+type GlogLogger struct{}
+
+// Errorf logs message at error level.
+func (GlogLogger) Errorf(format string, args ...interface{}) {
+	glog.Errorf(format, args...)
+}
+
+// Warningf logs message at warning level.
+func (GlogLogger) Warningf(format string, args ...interface{}) {
+	glog.Warningf(format, args...)
+}
+
+// Debugf logs message at info level with verbosity 2.
+func (GlogLogger) Debugf(format string, args ...interface{}) {
+	glog.V(2).Infof(format, args...)
+}
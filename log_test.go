@@ -0,0 +1,111 @@
+package wsproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"golang.org/x/net/websocket"
+)
+
+type testLogger struct {
+	mu     sync.Mutex
+	errors []string
+}
+
+func (l *testLogger) Errorf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Warningf(string, ...interface{}) {}
+
+func (l *testLogger) Debugf(string, ...interface{}) {}
+
+func (l *testLogger) Errors() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.errors...)
+}
+
+func captureLogger() (*testLogger, func()) {
+	prev := logger
+	l := &testLogger{}
+	SetLogger(l)
+	return l, func() { SetLogger(prev) }
+}
+
+func TestSetLogger(t *testing.T) {
+	l, restore := captureLogger()
+	defer restore()
+
+	c := Config{ConfigureConn: func(net.Conn) error {
+		return errors.New("dummy error")
+	}}
+	ts := httptest.NewServer(New(c, http.NotFoundHandler()))
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m string
+	assert.Equal(t, io.EOF, websocket.Message.Receive(ws, &m))
+	assert.Equal(t, []string{"shaxbee/go-wsproxy: Error configuring connection: dummy error"}, l.Errors())
+}
+
+func TestTeardownNotLogged(t *testing.T) {
+	l, restore := captureLogger()
+	defer restore()
+
+	done := make(chan struct{})
+	c := Config{OnDisconnect: func(*http.Request, Stats, error) { close(done) }}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		for {
+			if _, err := fmt.Fprintln(w, `"tick"`); err != nil {
+				return
+			}
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+
+	var m string
+	assert.NoError(t, websocket.Message.Receive(ws, &m))
+	assert.NoError(t, ws.Close())
+	wg.Wait()
+	<-done
+
+	assert.Empty(t, l.Errors())
+}
+
+func TestConnectionLabelsLogged(t *testing.T) {
+	l, restore := captureLogger()
+	defer restore()
+
+	c := Config{
+		ConfigureConn: func(net.Conn) error {
+			return errors.New("dummy error")
+		},
+		ConnectionLabels: func(r *http.Request) map[string]string {
+			return map[string]string{"tenant": "acme", "region": "eu%"}
+		},
+	}
+	ts := httptest.NewServer(New(c, http.NotFoundHandler()))
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m string
+	assert.Equal(t, io.EOF, websocket.Message.Receive(ws, &m))
+	assert.Equal(t, []string{"shaxbee/go-wsproxy: Error configuring connection: dummy error [region=eu% tenant=acme]"}, l.Errors())
+}
@@ -0,0 +1,30 @@
+package wsproxy
+
+// Metric is a measurement reported through Config.Metrics.
+type Metric struct {
+	// Name of metric, see Metric constants.
+	Name string
+	// Measured value, 1 for events.
+	Value float64
+	// Labels describing session metric was measured in.
+	Labels map[string]string
+}
+
+const (
+	// MetricNoOutput is reported when backend produced no output within Config.NoOutputThreshold.
+	// Usually indicates handler buffering whole response instead of streaming it.
+	MetricNoOutput = "backend_no_output"
+	// MetricWriteBlocked is reported once session ends with seconds spent blocked sending messages to websocket,
+	// see Stats.WriteBlocked.
+	MetricWriteBlocked = "write_blocked_seconds"
+	// MetricBackendStatus is reported once backend writes response status, labeled with LabelStatus.
+	// Status is reported even though it is not forwarded to websocket.
+	MetricBackendStatus = "backend_status"
+)
+
+const (
+	// LabelPath is a label containing path of websocket request.
+	LabelPath = "path"
+	// LabelStatus is a label containing status code of backend response.
+	LabelStatus = "status"
+)
@@ -0,0 +1,421 @@
+package wsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/net/websocket"
+)
+
+// ErrBadStream is returned when multiplexed message is missing stream ID.
+var ErrBadStream = errors.New("shaxbee/go-wsproxy: message missing stream id")
+
+// ErrStreamClosed is returned when multiplexed message is sent to stream closed by client
+// before its response ended.
+var ErrStreamClosed = errors.New("shaxbee/go-wsproxy: message for closed stream")
+
+const streamPrefixLen = 4
+
+// EncodeStream prefixes message with stream ID as 4-byte big-endian integer.
+// Empty message closes stream, see Config.Multiplex.
+func EncodeStream(id uint32, m []byte) []byte {
+	b := make([]byte, streamPrefixLen+len(m))
+	binary.BigEndian.PutUint32(b, id)
+	copy(b[streamPrefixLen:], m)
+	return b
+}
+
+// DecodeStream splits message encoded by EncodeStream into stream ID and message.
+func DecodeStream(b []byte) (uint32, []byte, error) {
+	if len(b) < streamPrefixLen {
+		return 0, nil, ErrBadStream
+	}
+	return binary.BigEndian.Uint32(b), b[streamPrefixLen:], nil
+}
+
+// mux dispatches logical streams of multiplexed session to separate backend requests.
+type mux struct {
+	wp  *WebSocketProxy
+	s   *session
+	h   http.Handler
+	req *http.Request
+	// base context of backend requests
+	ctx  context.Context
+	cred credentials
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+type muxStream struct {
+	b *backend
+	w *bufio.Writer
+	// backend stopped reading request, messages are discarded
+	discard bool
+	// request closed by client, stream ID is not reusable until response ends
+	closed bool
+}
+
+// multiplex proxies multiplexed session until either side tears it down.
+func (wp *WebSocketProxy) multiplex(ctx context.Context, s *session, h http.Handler, req *http.Request, rctx context.Context, cred credentials) {
+	m := &mux{wp: wp, s: s, h: h, req: req, ctx: rctx, cred: cred, streams: make(map[uint32]*muxStream)}
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		m.listenRead(ctx)
+	}()
+
+	<-ctx.Done()
+	s.closing()
+	m.close()
+
+	// Close acknowledgement or remaining messages are read by closeConn once listenRead returned.
+	s.interrupt()
+	<-readDone
+	s.closeConn()
+}
+
+// open dispatches backend request for stream.
+// Returns nil if session is closed or request could not be created.
+func (m *mux) open(ctx context.Context, id uint32) *muxStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+
+	b, err := m.wp.dispatch(m.h, m.req, m.ctx, m.cred, &responseForwarder{h: make(http.Header), s: m.s})
+	if err != nil {
+		m.s.log.Errorf("shaxbee/go-wsproxy: Error creating request for stream %d: %s", id, err)
+		return nil
+	}
+
+	st := &muxStream{b: b, w: bufio.NewWriter(b.owp)}
+	m.streams[id] = st
+
+	m.wg.Add(1)
+	go m.listenWrite(ctx, id, st)
+
+	return st
+}
+
+func (m *mux) stream(id uint32) *muxStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.streams[id]
+}
+
+// remove forgets stream so its ID can be reused.
+func (m *mux) remove(id uint32, st *muxStream) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.streams[id] == st {
+		delete(m.streams, id)
+	}
+}
+
+// close cancels backend requests of all streams and waits for them to finish.
+func (m *mux) close() {
+	m.mu.Lock()
+	m.closed = true
+	for _, st := range m.streams {
+		st.b.close()
+	}
+	m.mu.Unlock()
+
+	m.wg.Wait()
+}
+
+func (m *mux) listenRead(ctx context.Context) {
+	s := m.s
+	defer s.cancel()
+
+	// message buffer reused across reads
+	var buf bytes.Buffer
+	// number of messages received
+	n := 0
+	// bytes forwarded to request bodies
+	var total int64
+	// order of messages per stream if ReorderWindow is set
+	orders := make(map[uint32]*reorder)
+
+	for {
+		pt, b, err := receive(s.ws, &buf, s.c.MaxFragments)
+		if ce, ok := err.(*CloseError); ok {
+			s.closeReceived(ce)
+			return
+		} else if err == io.EOF {
+			s.close(closeReasonClient, nil)
+			return
+		} else if err == websocket.ErrFrameTooLarge {
+			s.log.Debugf("shaxbee/go-wsproxy: Message too large")
+			s.closeWith(CloseMessageTooBig, closeReasonError, err)
+			return
+		} else if ctx.Err() != nil {
+			// websocket closed during teardown
+			return
+		} else if isClientAborted(err) {
+			s.clientAborted(err)
+			return
+		} else if err != nil {
+			s.log.Errorf("shaxbee/go-wsproxy: Error while reading from websocket: %s", err)
+			s.fail(err)
+			return
+		}
+		n++
+		if s.c.MaxMessagesPerSession > 0 && n > s.c.MaxMessagesPerSession {
+			s.closeWith(s.c.limitCloseCode(), closeReasonLimit, nil)
+			return
+		}
+		s.received(len(b))
+
+		if s.c.ValidateUTF8 && pt == websocket.TextFrame && !utf8.Valid(b) {
+			s.log.Debugf("shaxbee/go-wsproxy: Text message is not valid UTF-8")
+			s.closeWith(CloseInvalidFramePayloadData, closeReasonError, ErrInvalidUTF8)
+			return
+		}
+
+		if !s.frameTypeMatches(pt) {
+			if s.c.OnFrameTypeMismatch == CloseOnMismatchedFrame {
+				s.closeWith(CloseUnsupportedData, closeReasonError, ErrFrameTypeMismatch)
+				return
+			}
+			s.log.Debugf("shaxbee/go-wsproxy: Dropped message with unexpected frame type %d", pt)
+			continue
+		}
+
+		id, msg, err := DecodeStream(b)
+		if err != nil && s.skipInvalid(err) {
+			continue
+		} else if err != nil {
+			s.log.Errorf("shaxbee/go-wsproxy: Invalid message: %s", err)
+			s.close(closeReasonError, err)
+			return
+		}
+
+		if s.c.ReorderWindow == 0 {
+			if !m.forward(ctx, id, msg, &total) {
+				return
+			}
+			continue
+		}
+
+		seq, msg, err := DecodeSequence(msg)
+		if err != nil && s.skipInvalid(err) {
+			continue
+		} else if err != nil {
+			s.log.Errorf("shaxbee/go-wsproxy: Invalid message: %s", err)
+			s.close(closeReasonError, err)
+			return
+		}
+		ro := orders[id]
+		if ro == nil {
+			ro = newReorder(s.c.ReorderWindow, s.budget)
+			orders[id] = ro
+		}
+		ready, ok, err := ro.push(seq, msg)
+		if err != nil {
+			s.overflow()
+			return
+		} else if !ok {
+			s.log.Debugf("shaxbee/go-wsproxy: Dropped message %d of stream %d outside of reorder window", seq, id)
+		}
+		for _, r := range ready {
+			if len(r) == 0 {
+				// Sequence restarts once stream is closed.
+				ro.discard()
+				delete(orders, id)
+			}
+			if !m.forward(ctx, id, r, &total) {
+				return
+			}
+		}
+	}
+}
+
+// forward writes message to request of stream opening it if necessary.
+// total counts bytes forwarded to request bodies.
+// Returns false if session was closed.
+func (m *mux) forward(ctx context.Context, id uint32, msg []byte, total *int64) bool {
+	s := m.s
+
+	st := m.stream(id)
+	if len(msg) == 0 {
+		// Empty message closes request of stream.
+		if st != nil && !st.closed {
+			st.closed = true
+			st.b.owp.Close()
+		}
+		return true
+	}
+	if st != nil && st.closed {
+		if s.skipInvalid(ErrStreamClosed) {
+			return true
+		}
+		s.log.Errorf("shaxbee/go-wsproxy: Invalid message for stream %d: %s", id, ErrStreamClosed)
+		s.close(closeReasonError, ErrStreamClosed)
+		return false
+	}
+	if !s.simulate(ctx) {
+		return true
+	}
+	if st == nil {
+		if st = m.open(ctx, id); st == nil {
+			return true
+		}
+	}
+	if st.discard {
+		return true
+	}
+
+	*total += int64(len(msg))
+	if s.c.MaxRequestBodyBytes > 0 && *total > s.c.MaxRequestBodyBytes {
+		s.closeWith(CloseMessageTooBig, closeReasonBodyLimit, nil)
+		return false
+	}
+
+	err := s.writeRecord(st.w, msg)
+	if err == ErrBadRecord && s.skipInvalid(err) {
+		return true
+	} else if err == ErrBadRecord {
+		s.log.Errorf("shaxbee/go-wsproxy: Invalid message: %s", err)
+		s.close(closeReasonError, err)
+		return false
+	} else if err == nil {
+		err = st.w.Flush()
+	}
+	if err == io.ErrClosedPipe {
+		s.log.Debugf("shaxbee/go-wsproxy: Request of stream %d closed, discarding messages", id)
+		st.discard = true
+	} else if err != nil {
+		s.log.Errorf("shaxbee/go-wsproxy: Error while writing request of stream %d: %s", id, err)
+		st.discard = true
+	}
+	return true
+}
+
+// reorder restores order of stream messages by sequence number.
+type reorder struct {
+	// sequence number of next message to deliver
+	next   uint64
+	window int
+	// messages received ahead of next by sequence number
+	pending map[uint64][]byte
+	// accounts pending messages against session limit
+	budget *budget
+}
+
+func newReorder(window int, b *budget) *reorder {
+	return &reorder{window: window, pending: make(map[uint64][]byte), budget: b}
+}
+
+// push accepts message with sequence number returning messages ready for delivery in order.
+// Returns false if message was dropped as duplicate or too far ahead of next message.
+// Returned messages other than m are owned by caller.
+// Returns ErrSessionBufferFull if buffering m exceeds session limit.
+func (r *reorder) push(seq uint64, m []byte) ([][]byte, bool, error) {
+	if seq < r.next || seq-r.next > uint64(r.window) {
+		return nil, false, nil
+	}
+	if seq > r.next {
+		if _, ok := r.pending[seq]; ok {
+			return nil, false, nil
+		}
+		if err := r.budget.reserve(len(m)); err != nil {
+			return nil, false, err
+		}
+		r.pending[seq] = append([]byte(nil), m...)
+		return nil, true, nil
+	}
+
+	ready := [][]byte{m}
+	r.next++
+	for {
+		b, ok := r.pending[r.next]
+		if !ok {
+			return ready, true, nil
+		}
+		r.budget.release(len(b))
+		delete(r.pending, r.next)
+		ready = append(ready, b)
+		r.next++
+	}
+}
+
+// discard drops pending messages.
+func (r *reorder) discard() {
+	for seq, b := range r.pending {
+		r.budget.release(len(b))
+		delete(r.pending, seq)
+	}
+}
+
+// listenWrite forwards response of stream tagged with stream ID.
+// Empty message is sent once response ends.
+func (m *mux) listenWrite(ctx context.Context, id uint32, st *muxStream) {
+	defer m.wg.Done()
+
+	s := m.s
+	next := s.records(bufio.NewReader(st.b.body()))
+	// last record sent, see Config.DedupeOutput
+	var last []byte
+	sentAny := false
+	for {
+		rec, err := next()
+		if err == io.EOF && len(rec) > 0 {
+			// Send final record without trailing newline, EOF is returned by next read.
+			err = nil
+		}
+		if err == io.EOF {
+			break
+		} else if err == io.ErrClosedPipe {
+			return
+		} else if err == ErrBadJSON && s.skipInvalid(err) {
+			continue
+		} else if err != nil {
+			s.log.Errorf("shaxbee/go-wsproxy: Error while reading response of stream %d: %s", id, err)
+			break
+		}
+
+		if s.c.DedupeOutput {
+			if sentAny && bytes.Equal(rec, last) {
+				continue
+			}
+			last = append(last[:0], rec...)
+			sentAny = true
+		}
+
+		if !s.simulate(ctx) {
+			continue
+		}
+		if err := s.send(EncodeStream(id, rec)); err != nil {
+			if isConnClosed(err) {
+				s.log.Debugf("shaxbee/go-wsproxy: Websocket closed while writing stream %d: %s", id, err)
+			} else {
+				s.log.Errorf("shaxbee/go-wsproxy: Error while writing stream %d to websocket: %s", id, err)
+			}
+			s.fail(err)
+			s.cancel()
+			return
+		}
+		s.sent(len(rec))
+	}
+
+	m.remove(id, st)
+	if err := s.send(EncodeStream(id, nil)); err != nil {
+		s.log.Debugf("shaxbee/go-wsproxy: Error while closing stream %d: %s", id, err)
+	}
+}
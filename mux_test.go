@@ -0,0 +1,232 @@
+package wsproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestMultiplex(t *testing.T) {
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer wg.Done()
+		br := bufio.NewReader(r.Body)
+		for {
+			l, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fmt.Fprint(w, l)
+		}
+	})
+	ts := httptest.NewServer(New(Config{Multiplex: true}, h))
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	require.NoError(t, websocket.Message.Send(ws, EncodeStream(1, []byte("one"))))
+	require.NoError(t, websocket.Message.Send(ws, EncodeStream(2, []byte("two"))))
+
+	received := func() map[uint32]string {
+		m := make(map[uint32]string)
+		for i := 0; i < 2; i++ {
+			var b []byte
+			require.NoError(t, websocket.Message.Receive(ws, &b))
+			id, msg, err := DecodeStream(b)
+			require.NoError(t, err)
+			m[id] = string(msg)
+		}
+		return m
+	}
+	assert.Equal(t, map[uint32]string{1: "one\n", 2: "two\n"}, received())
+
+	// Closing requests ends streams.
+	require.NoError(t, websocket.Message.Send(ws, EncodeStream(1, nil)))
+	require.NoError(t, websocket.Message.Send(ws, EncodeStream(2, nil)))
+	assert.Equal(t, map[uint32]string{1: "", 2: ""}, received())
+	wg.Wait()
+}
+
+func TestMultiplexDedupeOutput(t *testing.T) {
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer wg.Done()
+		for _, m := range []string{"foo", "foo", "bar", "bar", "foo"} {
+			fmt.Fprintln(w, m)
+		}
+	})
+	ts := httptest.NewServer(New(Config{Multiplex: true, DedupeOutput: true}, h))
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	require.NoError(t, websocket.Message.Send(ws, EncodeStream(1, []byte("one"))))
+	require.NoError(t, websocket.Message.Send(ws, EncodeStream(2, []byte("two"))))
+
+	// Records are deduplicated within stream, not across streams.
+	recv := make(map[uint32][]string)
+	for ended := 0; ended < 2; {
+		var b []byte
+		require.NoError(t, websocket.Message.Receive(ws, &b))
+		id, msg, err := DecodeStream(b)
+		require.NoError(t, err)
+		if len(msg) == 0 {
+			ended++
+			continue
+		}
+		recv[id] = append(recv[id], string(msg))
+	}
+	want := []string{"foo\n", "bar\n", "foo\n"}
+	assert.Equal(t, map[uint32][]string{1: want, 2: want}, recv)
+	wg.Wait()
+}
+
+func TestMultiplexStreamReuse(t *testing.T) {
+	for _, policy := range []ErrorPolicy{CloseOnInvalidMessage, SkipInvalidMessages} {
+		closed := make(chan struct{})
+		release := make(chan struct{})
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			if string(b) == "one\n" {
+				// Response of first stream outlives its request.
+				close(closed)
+				<-release
+			}
+			w.Write(b)
+		})
+		ts := httptest.NewServer(New(Config{Multiplex: true, ErrorPolicy: policy}, h))
+		defer ts.Close()
+
+		ws := dial(t, ts)
+		defer ws.Close()
+		require.NoError(t, ws.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+		receive := func() (uint32, string) {
+			var b []byte
+			require.NoError(t, websocket.Message.Receive(ws, &b))
+			id, msg, err := DecodeStream(b)
+			require.NoError(t, err)
+			return id, string(msg)
+		}
+		// roundtrip sends message to stream and closes it, returns response of stream.
+		roundtrip := func(id uint32, m string) string {
+			require.NoError(t, websocket.Message.Send(ws, EncodeStream(id, []byte(m))))
+			require.NoError(t, websocket.Message.Send(ws, EncodeStream(id, nil)))
+			var resp string
+			for {
+				rid, msg := receive()
+				require.Equal(t, id, rid)
+				if msg == "" {
+					return resp
+				}
+				resp += msg
+			}
+		}
+
+		require.NoError(t, websocket.Message.Send(ws, EncodeStream(1, []byte("one"))))
+		require.NoError(t, websocket.Message.Send(ws, EncodeStream(1, nil)))
+		<-closed
+
+		// Stream ID is reused before response ended.
+		require.NoError(t, websocket.Message.Send(ws, EncodeStream(1, []byte("two"))))
+		if policy == CloseOnInvalidMessage {
+			assert.Equal(t, CloseNormalClosure, receiveClose(t, ws))
+			close(release)
+			continue
+		}
+		// Message was dropped once another stream was served.
+		assert.Equal(t, "sync\n", roundtrip(2, "sync"))
+		close(release)
+		id, msg := receive()
+		assert.Equal(t, uint32(1), id)
+		assert.Equal(t, "one\n", msg)
+		id, msg = receive()
+		assert.Equal(t, uint32(1), id)
+		assert.Equal(t, "", msg)
+
+		// Stream ID is reusable once response ended.
+		assert.Equal(t, "three\n", roundtrip(1, "three"))
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	_, _, err := DecodeStream([]byte{0, 1})
+	assert.Equal(t, ErrBadStream, err)
+
+	id, m, err := DecodeStream(EncodeStream(42, []byte("hello")))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(42), id)
+	assert.Equal(t, "hello", string(m))
+}
+
+func TestReorderWindow(t *testing.T) {
+	done := make(chan []string, 1)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var lines []string
+		br := bufio.NewReader(r.Body)
+		for {
+			l, err := br.ReadString('\n')
+			if err != nil {
+				done <- lines
+				return
+			}
+			lines = append(lines, l)
+		}
+	})
+	ts := httptest.NewServer(New(Config{Multiplex: true, ReorderWindow: 2}, h))
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	send := func(seq uint64, m string) {
+		require.NoError(t, websocket.Message.Send(ws, EncodeStream(1, EncodeSequence(seq, []byte(m)))))
+	}
+	send(2, "two")
+	send(5, "dropped")
+	send(1, "one")
+	send(1, "duplicate")
+	send(0, "zero")
+	send(3, "")
+
+	assert.Equal(t, []string{"zero\n", "one\n", "two\n"}, <-done)
+}
+
+func TestReorder(t *testing.T) {
+	b := newBudget(3)
+	r := newReorder(2, b)
+
+	ready, ok, err := r.push(1, []byte("one"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Empty(t, ready)
+
+	_, _, err = r.push(2, []byte("two"))
+	assert.Equal(t, ErrSessionBufferFull, err)
+
+	_, ok, _ = r.push(3, []byte("three"))
+	assert.False(t, ok)
+
+	ready, ok, err = r.push(0, []byte("zero"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, [][]byte{[]byte("zero"), []byte("one")}, ready)
+	assert.Equal(t, 0, b.used)
+
+	_, ok, _ = r.push(1, []byte("one"))
+	assert.False(t, ok)
+}
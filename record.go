@@ -0,0 +1,66 @@
+package wsproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/net/websocket"
+)
+
+// ErrBadRecord is returned when length prefix does not match length of record.
+var ErrBadRecord = errors.New("shaxbee/go-wsproxy: length prefix does not match record")
+
+// ErrRecordTooLarge is returned by ReadRecord if record exceeds websocket.DefaultMaxPayloadBytes.
+var ErrRecordTooLarge = errors.New("shaxbee/go-wsproxy: record too large")
+
+const recordPrefixLen = 4
+
+// WriteRecord writes b prefixed with its length as 4-byte big-endian integer in a single write.
+// Writing record to websocket.Conn sends it as single frame.
+func WriteRecord(w io.Writer, b []byte) error {
+	buf := make([]byte, recordPrefixLen+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[recordPrefixLen:], b)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadRecord reads record written by WriteRecord and returns it without length prefix.
+// Returns io.EOF only if no bytes were read.
+func ReadRecord(r io.Reader) ([]byte, error) {
+	b, err := readRecord(r)
+	if err != nil {
+		return nil, err
+	}
+	return b[recordPrefixLen:], nil
+}
+
+// readRecord reads length prefixed record including prefix.
+func readRecord(r io.Reader) ([]byte, error) {
+	var prefix [recordPrefixLen]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(prefix[:])
+	if n > websocket.DefaultMaxPayloadBytes {
+		return nil, ErrRecordTooLarge
+	}
+
+	b := make([]byte, recordPrefixLen+int(n))
+	copy(b, prefix[:])
+	if _, err := io.ReadFull(r, b[recordPrefixLen:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// validRecord reports whether length prefix of b matches its length.
+func validRecord(b []byte) bool {
+	return len(b) >= recordPrefixLen && int(binary.BigEndian.Uint32(b)) == len(b)-recordPrefixLen
+}
@@ -0,0 +1,255 @@
+package wsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestRecord(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteRecord(&buf, []byte("foo\nbar")))
+	require.NoError(t, WriteRecord(&buf, nil))
+	assert.Equal(t, []byte{0, 0, 0, 7}, buf.Bytes()[:4])
+
+	b, err := ReadRecord(&buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "foo\nbar", string(b))
+	}
+	b, err = ReadRecord(&buf)
+	if assert.NoError(t, err) {
+		assert.Empty(t, b)
+	}
+	_, err = ReadRecord(&buf)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = ReadRecord(bytes.NewReader([]byte{0, 0, 0, 7, 'f'}))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestLengthPrefixed(t *testing.T) {
+	c := Config{LengthPrefixed: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		for {
+			b, err := ReadRecord(r.Body)
+			if err == io.EOF {
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, WriteRecord(w, append(b, "\n!"...)))
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	for _, m := range []string{"foo\nbar", "baz"} {
+		require.NoError(t, WriteRecord(ws, []byte(m)))
+
+		var b []byte
+		require.NoError(t, websocket.Message.Receive(ws, &b))
+		assert.Equal(t, []byte{0, 0, 0, byte(len(m) + 2)}, b[:4])
+		assert.Equal(t, m+"\n!", string(b[4:]))
+	}
+
+	// length prefix mismatch terminates session
+	require.NoError(t, websocket.Message.Send(ws, []byte{0, 0, 0, 9, 'f'}))
+	var b []byte
+	assert.Equal(t, io.EOF, websocket.Message.Receive(ws, &b))
+
+	wg.Wait()
+}
+
+func TestReadJSON(t *testing.T) {
+	in := "{\"foo\": \"a\\\"}\\nb\",\n \"bar\": [1,\n2]}\n\"baz\" 42 [] null"
+	r := bufio.NewReader(strings.NewReader(in))
+
+	var got []string
+	for {
+		b, err := readJSON(r, json.Valid)
+		if len(b) > 0 {
+			got = append(got, string(b))
+		}
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"{\"foo\": \"a\\\"}\\nb\",\n \"bar\": [1,\n2]}", `"baz"`, "42", "[]", "null"}, got)
+
+	_, err := readJSON(bufio.NewReader(strings.NewReader(`{"foo":`)), json.Valid)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = readJSON(bufio.NewReader(strings.NewReader("foo\n")), json.Valid)
+	assert.Equal(t, ErrBadJSON, err)
+}
+
+func TestJSONAwareFraming(t *testing.T) {
+	c := Config{JSONAwareFraming: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "{\n  \"foo\": \"bar\\nbaz\"\n}\n{\"foo\": \"qux\"}")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	for _, exp := range []string{"bar\nbaz", "qux"} {
+		var m Message
+		if assert.NoError(t, websocket.JSON.Receive(ws, &m)) {
+			assert.Equal(t, exp, m.Foo)
+		}
+	}
+
+	wg.Wait()
+}
+
+func TestFirstLineIsMetadata(t *testing.T) {
+	c := Config{FirstLineIsMetadata: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "{\"stream\": \"foo\"}\n{\"foo\": \"bar\"}\n")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m string
+	require.NoError(t, websocket.Message.Receive(ws, &m))
+	assert.JSONEq(t, `{"metadata": {"stream": "foo"}}`, m)
+	require.NoError(t, websocket.Message.Receive(ws, &m))
+	assert.Equal(t, "{\"foo\": \"bar\"}\n", m)
+
+	wg.Wait()
+}
+
+func TestSplitFunc(t *testing.T) {
+	// records prefixed with single byte length
+	split := func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) == 0 || len(data) < 1+int(data[0]) {
+			if atEOF && len(data) > 0 {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			return 0, nil, nil
+		}
+		n := 1 + int(data[0])
+		return n, data[1:n], nil
+	}
+
+	for _, tc := range []struct {
+		name  string
+		split bufio.SplitFunc
+		resp  string
+		exp   []string
+	}{
+		{name: "words", split: bufio.ScanWords, resp: "foo bar\nbaz", exp: []string{"foo", "bar", "baz"}},
+		{name: "prefixed", split: split, resp: "\x03foo\x07bar\nbaz", exp: []string{"foo", "bar\nbaz"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Config{SplitFunc: tc.split}
+			ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, tc.resp)
+			})
+			defer ts.Close()
+
+			ws := dial(t, ts)
+			defer ws.Close()
+
+			for _, exp := range tc.exp {
+				var m string
+				if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+					assert.Equal(t, exp, m)
+				}
+			}
+
+			wg.Wait()
+		})
+	}
+}
+
+func TestSplitFuncInvalid(t *testing.T) {
+	_, err := NewWithError(Config{SplitFunc: bufio.ScanWords, JSONAwareFraming: true}, http.NotFoundHandler())
+	assert.Error(t, err)
+}
+
+func TestErrorPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy ErrorPolicy
+		exp    []string
+	}{
+		{name: "close", policy: CloseOnInvalidMessage, exp: []string{"foo"}},
+		{name: "skip", policy: SkipInvalidMessages, exp: []string{"foo", "bar"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Config{LengthPrefixed: true, ErrorPolicy: tc.policy}
+			done := make(chan []string, 1)
+			ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+				var records []string
+				for {
+					b, err := ReadRecord(r.Body)
+					if err != nil {
+						break
+					}
+					records = append(records, string(b))
+				}
+				done <- records
+			})
+			defer ts.Close()
+
+			ws := dial(t, ts)
+			defer ws.Close()
+
+			require.NoError(t, WriteRecord(ws, []byte("foo")))
+			require.NoError(t, websocket.Message.Send(ws, []byte{0, 0, 0, 9, 'f'}))
+			require.NoError(t, WriteRecord(ws, []byte("bar")))
+			require.NoError(t, ws.Close())
+
+			assert.Equal(t, tc.exp, <-done)
+			wg.Wait()
+		})
+	}
+}
+
+func TestErrorPolicyJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy ErrorPolicy
+		exp    []string
+	}{
+		{name: "close", policy: CloseOnInvalidMessage, exp: []string{"foo"}},
+		{name: "skip", policy: SkipInvalidMessages, exp: []string{"foo", "bar"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Config{JSONAwareFraming: true, ErrorPolicy: tc.policy}
+			ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{"foo":"foo"} {foo} {"foo":"bar"}`)
+			})
+			defer ts.Close()
+
+			ws := dial(t, ts)
+			defer ws.Close()
+
+			var received []string
+			for {
+				var m Message
+				if err := websocket.JSON.Receive(ws, &m); err != nil {
+					break
+				}
+				received = append(received, m.Foo)
+			}
+			assert.Equal(t, tc.exp, received)
+
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package wsproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrBadSequence is returned when reliable message is missing sequence number.
+var ErrBadSequence = errors.New("shaxbee/go-wsproxy: message missing sequence number")
+
+// ErrResendBufferFull is reported when client did not acknowledge Config.ResendBuffer messages.
+var ErrResendBufferFull = errors.New("shaxbee/go-wsproxy: resend buffer full")
+
+const (
+	seqPrefixLen = 8
+
+	defaultResendBuffer = 256
+)
+
+// EncodeSequence prefixes message with sequence number as 8-byte big-endian integer.
+// Message with sequence number only acknowledges messages up to sequence number, see Config.Reliable.
+func EncodeSequence(seq uint64, m []byte) []byte {
+	b := make([]byte, seqPrefixLen+len(m))
+	binary.BigEndian.PutUint64(b, seq)
+	copy(b[seqPrefixLen:], m)
+	return b
+}
+
+// DecodeSequence splits message encoded by EncodeSequence into sequence number and message.
+func DecodeSequence(b []byte) (uint64, []byte, error) {
+	if len(b) < seqPrefixLen {
+		return 0, nil, ErrBadSequence
+	}
+	return binary.BigEndian.Uint64(b), b[seqPrefixLen:], nil
+}
+
+// resendBuffer retains messages sent to client until acknowledged.
+type resendBuffer struct {
+	id  string
+	max int
+
+	mu  sync.Mutex
+	seq uint64
+	// encoded messages ordered by sequence number
+	unacked [][]byte
+	// expires parked buffer, guarded by resumeRegistry
+	expiry *time.Timer
+}
+
+func newResendBuffer(id string, max int) *resendBuffer {
+	return &resendBuffer{id: id, max: max}
+}
+
+// push assigns next sequence number to m and retains it until acknowledged.
+// Returns encoded message.
+func (rb *resendBuffer) push(m []byte) ([]byte, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if len(rb.unacked) >= rb.max {
+		return nil, ErrResendBufferFull
+	}
+	rb.seq++
+	b := EncodeSequence(rb.seq, m)
+	rb.unacked = append(rb.unacked, b)
+	return b, nil
+}
+
+// ack releases messages up to and including seq.
+// Returns total size of released messages.
+func (rb *resendBuffer) ack(seq uint64) int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	i, n := 0, 0
+	for i < len(rb.unacked) && binary.BigEndian.Uint64(rb.unacked[i]) <= seq {
+		n += len(rb.unacked[i])
+		i++
+	}
+	rb.unacked = rb.unacked[i:]
+	return n
+}
+
+// pending returns encoded messages not acknowledged yet.
+func (rb *resendBuffer) pending() [][]byte {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	return append([][]byte(nil), rb.unacked...)
+}
+
+// resumeRegistry retains resend buffers of disconnected sessions until resumed or expired.
+type resumeRegistry struct {
+	mu      sync.Mutex
+	buffers map[string]*resendBuffer
+}
+
+func newResumeRegistry() *resumeRegistry {
+	return &resumeRegistry{buffers: make(map[string]*resendBuffer)}
+}
+
+// park retains rb for d.
+func (r *resumeRegistry) park(rb *resendBuffer, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buffers[rb.id] = rb
+	rb.expiry = time.AfterFunc(d, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if r.buffers[rb.id] == rb {
+			delete(r.buffers, rb.id)
+		}
+	})
+}
+
+// take removes parked buffer with id.
+// Returns nil if buffer expired or does not exist.
+func (r *resumeRegistry) take(id string) *resendBuffer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rb := r.buffers[id]
+	if rb != nil {
+		delete(r.buffers, id)
+		rb.expiry.Stop()
+	}
+	return rb
+}
+
+// resendBuffer returns buffer of session resumed by request or creates new one.
+func (wp *WebSocketProxy) resendBuffer(req *http.Request) *resendBuffer {
+	if id := req.URL.Query().Get(resumeParam); id != "" {
+		if rb := wp.resumable.take(id); rb != nil {
+			return rb
+		}
+	}
+
+	max := wp.c.ResendBuffer
+	if max == 0 {
+		max = defaultResendBuffer
+	}
+	return newResendBuffer(randomID(), max)
+}
+
+// park retains unacknowledged messages of session for ResumeTimeout.
+func (wp *WebSocketProxy) park(rb *resendBuffer) {
+	if wp.c.ResumeTimeout > 0 && len(rb.pending()) > 0 {
+		wp.resumable.park(rb, wp.c.ResumeTimeout)
+	}
+}
+
+// resumeParam is a query parameter containing ID of resumed session.
+const resumeParam = "resume"
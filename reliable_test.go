@@ -0,0 +1,131 @@
+package wsproxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestReliable(t *testing.T) {
+	var calls int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			fmt.Fprint(w, "one\ntwo\n")
+			// Wait for session to end.
+			io.Copy(ioutil.Discard, r.Body)
+			return
+		}
+		fmt.Fprint(w, "three\n")
+		io.Copy(ioutil.Discard, r.Body)
+	})
+	disconnected := make(chan struct{}, 2)
+	c := Config{
+		Reliable:      true,
+		ResumeTimeout: time.Minute,
+		OnDisconnect:  func(*http.Request, Stats, error) { disconnected <- struct{}{} },
+	}
+	ts := httptest.NewServer(New(c, h))
+	defer ts.Close()
+
+	receive := func(ws *websocket.Conn) (uint64, string) {
+		var b []byte
+		require.NoError(t, websocket.Message.Receive(ws, &b))
+		seq, m, err := DecodeSequence(b)
+		require.NoError(t, err)
+		return seq, string(m)
+	}
+
+	ws := dial(t, ts)
+	seq, id := receive(ws)
+	assert.Equal(t, uint64(0), seq)
+	assert.NotEmpty(t, id)
+
+	seq, m := receive(ws)
+	assert.Equal(t, uint64(1), seq)
+	assert.Equal(t, "one\n", m)
+	seq, m = receive(ws)
+	assert.Equal(t, uint64(2), seq)
+	assert.Equal(t, "two\n", m)
+
+	// Acknowledge first message only.
+	require.NoError(t, websocket.Message.Send(ws, EncodeSequence(1, nil)))
+	// Text frames are forwarded to backend.
+	require.NoError(t, websocket.Message.Send(ws, "hello"))
+	require.NoError(t, ws.Close())
+	<-disconnected
+
+	url := strings.Replace(ts.URL, "http://", "ws://", 1) + "?" + resumeParam + "=" + id
+	ws, err := websocket.Dial(url, "", ts.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	seq, resumed := receive(ws)
+	assert.Equal(t, uint64(0), seq)
+	assert.Equal(t, id, resumed)
+
+	seq, m = receive(ws)
+	assert.Equal(t, uint64(2), seq)
+	assert.Equal(t, "two\n", m)
+	seq, m = receive(ws)
+	assert.Equal(t, uint64(3), seq)
+	assert.Equal(t, "three\n", m)
+}
+
+func TestResendBufferFull(t *testing.T) {
+	c := Config{Reliable: true, ResendBuffer: 1}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "one\ntwo\n")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	assert.Equal(t, ClosePolicyViolation, receiveClose(t, ws))
+	wg.Wait()
+}
+
+func TestAck(t *testing.T) {
+	rb := newResendBuffer("id", 3)
+	for _, m := range []string{"a", "b", "c"} {
+		_, err := rb.push([]byte(m))
+		require.NoError(t, err)
+	}
+	_, err := rb.push([]byte("d"))
+	assert.Equal(t, ErrResendBufferFull, err)
+
+	rb.ack(2)
+	if pending := rb.pending(); assert.Len(t, pending, 1) {
+		assert.Equal(t, EncodeSequence(3, []byte("c")), pending[0])
+	}
+
+	// Stale acknowledgement is ignored.
+	rb.ack(1)
+	assert.Len(t, rb.pending(), 1)
+}
+
+func TestReliableResumeUnknown(t *testing.T) {
+	ts := httptest.NewServer(New(Config{Reliable: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer ts.Close()
+
+	ws, err := websocket.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"?"+resumeParam+"=unknown", "", ts.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	var b []byte
+	require.NoError(t, websocket.Message.Receive(ws, &b))
+	_, id, err := DecodeSequence(b)
+	require.NoError(t, err)
+	assert.NotEqual(t, "unknown", string(id))
+}
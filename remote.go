@@ -0,0 +1,74 @@
+package wsproxy
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// remoteHandler dispatches backend requests to target through Config.Transport.
+type remoteHandler struct {
+	t      http.RoundTripper
+	target *url.URL
+	// reuse connection once request ends, see Config.BackendKeepAlive
+	keepAlive bool
+}
+
+// remote returns handler dispatching requests to URL selected by Config.TargetURL.
+func (wp *WebSocketProxy) remote(r *http.Request) (http.Handler, error) {
+	var target *url.URL
+	var err error
+	if !wp.c.hook(nil, "TargetURL", func() { target, err = wp.c.TargetURL(r) }) {
+		return nil, ErrHookPanic
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &remoteHandler{t: wp.c.Transport, target: target, keepAlive: wp.c.BackendKeepAlive}, nil
+}
+
+func (h *remoteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	out := r.Clone(r.Context())
+	u := *h.target
+	out.URL = &u
+	out.Host = ""
+	out.RequestURI = ""
+	out.Close = !h.keepAlive
+
+	resp, err := h.t.RoundTrip(out)
+	if err != nil {
+		logger.Errorf("shaxbee/go-wsproxy: Error dispatching request to %s: %s", redacted(h.target), err)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// Stream response as it arrives.
+	f, _ := w.(http.Flusher)
+	b := make([]byte, 4096)
+	for {
+		n, err := resp.Body.Read(b)
+		if n > 0 {
+			if _, err := w.Write(b[:n]); err != nil {
+				return
+			}
+			if f != nil {
+				f.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// redacted returns u without user information for logging.
+func redacted(u *url.URL) string {
+	r := *u
+	r.User = nil
+	return r.String()
+}
@@ -0,0 +1,111 @@
+package wsproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestTargetURL(t *testing.T) {
+	backends := make(map[string]*url.URL)
+	for _, name := range []string{"foo", "bar"} {
+		name := name
+		bs := httptest.NewServer(fullDuplex(t, func(w io.Writer, r *http.Request) {
+			fmt.Fprintf(w, "%s %s\n", name, r.URL.Path)
+		}))
+		defer bs.Close()
+
+		u, err := url.Parse(bs.URL + "/stream")
+		require.NoError(t, err)
+		backends[name] = u
+	}
+
+	c := Config{
+		Transport: http.DefaultTransport,
+		TargetURL: func(r *http.Request) (*url.URL, error) {
+			if u, ok := backends[strings.TrimPrefix(r.URL.Path, "/")]; ok {
+				return u, nil
+			}
+			return nil, errors.New("unknown backend")
+		},
+	}
+	ts := httptest.NewServer(New(c, nil))
+	defer ts.Close()
+
+	for _, name := range []string{"foo", "bar"} {
+		ws, err := websocket.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/"+name, "", ts.URL)
+		require.NoError(t, err)
+
+		var m string
+		if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+			assert.Equal(t, name+" /stream\n", m)
+		}
+		ws.Close()
+	}
+
+	resp, err := http.Get(ts.URL + "/baz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	_, err = websocket.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/baz", "", ts.URL)
+	assert.Error(t, err)
+}
+
+func TestBackendKeepAlive(t *testing.T) {
+	for _, keepAlive := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keepalive=%t", keepAlive), func(t *testing.T) {
+			closed := make(chan bool, 1)
+			bs := httptest.NewServer(fullDuplex(t, func(w io.Writer, r *http.Request) {
+				closed <- r.Close
+				fmt.Fprintln(w, "foo")
+			}))
+			defer bs.Close()
+
+			u, err := url.Parse(bs.URL)
+			require.NoError(t, err)
+			c := Config{
+				Transport:        &http.Transport{},
+				TargetURL:        func(*http.Request) (*url.URL, error) { return u, nil },
+				BackendKeepAlive: keepAlive,
+			}
+			ts := httptest.NewServer(New(c, nil))
+			defer ts.Close()
+
+			ws, err := websocket.Dial(strings.Replace(ts.URL, "http://", "ws://", 1), "", ts.URL)
+			require.NoError(t, err)
+			defer ws.Close()
+
+			var m string
+			require.NoError(t, websocket.Message.Receive(ws, &m))
+			assert.Equal(t, "foo\n", m)
+			assert.Equal(t, !keepAlive, <-closed)
+		})
+	}
+}
+
+// fullDuplex responds with output of f while request body is still streaming.
+// Response is written to hijacked connection as net/http server waits for request body to end.
+func fullDuplex(t *testing.T, f func(w io.Writer, r *http.Request)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, bw, err := w.(http.Hijacker).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+
+		bw.WriteString("HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n")
+		f(bw, r)
+		assert.NoError(t, bw.Flush())
+	})
+}
@@ -0,0 +1,1119 @@
+package wsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/websocket"
+)
+
+// Stats summarizes proxied websocket session.
+type Stats struct {
+	// Number of messages received from websocket.
+	MessagesIn int64 `json:"messages_in"`
+	// Number of messages sent to websocket.
+	MessagesOut int64 `json:"messages_out"`
+	// Number of payload bytes received from websocket.
+	BytesIn int64 `json:"bytes_in"`
+	// Number of payload bytes sent to websocket.
+	BytesOut int64 `json:"bytes_out"`
+	// Duration of session in nanoseconds.
+	Duration time.Duration `json:"duration"`
+	// Reason session was terminated.
+	CloseReason string `json:"close_reason"`
+	// Status code of close frame sent by client or proxy.
+	CloseCode int `json:"close_code,omitempty"`
+	// Reason sent by client in close frame.
+	CloseText string `json:"close_text,omitempty"`
+	// Request ID propagated to backend, see Config.RequestIDHeader.
+	RequestID string `json:"request_id,omitempty"`
+	// Time spent blocked sending messages to websocket in nanoseconds.
+	// High values indicate slow client applying backpressure to backend.
+	WriteBlocked time.Duration `json:"write_blocked"`
+}
+
+const (
+	closeReasonClient       = "client closed"
+	closeReasonBackend      = "backend closed"
+	closeReasonRequest      = "request closed"
+	closeReasonError        = "error"
+	closeReasonIdle         = "idle timeout"
+	closeReasonTimeout      = "session timeout"
+	closeReasonRedirect     = "redirect"
+	closeReasonLimit        = "message limit"
+	closeReasonUnauthorized = "unauthorized"
+	closeReasonRejected     = "rejected"
+	closeReasonBodyLimit    = "request body limit"
+	closeReasonUnacked      = "resend buffer full"
+	closeReasonShutdown     = "shutdown"
+	closeReasonBackendError = "backend error"
+	closeReasonFirstByte    = "first byte timeout"
+	closeReasonFirstFrame   = "first frame timeout"
+	closeReasonBufferLimit  = "session buffer limit"
+	closeReasonAborted      = "client aborted"
+	closeReasonHandlerLimit = "handler limit"
+)
+
+const defaultKeepaliveMessage = "{}"
+
+// Draining messages of client once close frame is sent ends after closeLinger
+// or once client is not sending for closeLingerIdle, see session.linger.
+const (
+	closeLinger     = time.Second
+	closeLingerIdle = 50 * time.Millisecond
+)
+
+type session struct {
+	c   *Config
+	req *http.Request
+	// labels from Config.ConnectionLabels
+	labels map[string]string
+	log    labeledLogger
+	ws     *websocket.Conn
+	conn   net.Conn
+	cancel context.CancelFunc
+	start  time.Time
+	once   sync.Once
+	// buffered input of websocket, nil if not known, see Config.FlushEachInboundFrame
+	inbound *bufio.Reader
+
+	mu    sync.Mutex
+	stats Stats
+	// error that terminated session
+	err error
+	// websocket close status code
+	code int
+	// websocket close reason
+	text string
+	// location backend redirected to
+	redirect string
+	// error reported by backend through Config.ErrorHeader
+	backendError string
+	// close status code requested by backend through Config.CloseCodeHeader
+	backendCode int
+	// response declared binary content type, see Config.FrameTypeFromContentType
+	binary bool
+	// websocket transport failed, nothing more can be sent
+	failed bool
+	// close frame received from client
+	peerClosed bool
+
+	idle     *time.Timer
+	timeout  *time.Timer
+	noOutput *time.Timer
+	// closes session unless backend produced output, see Config.FirstByteTimeout
+	firstByte *time.Timer
+	// closes session unless client sent message, see Config.FirstFrameTimeout
+	firstFrame *time.Timer
+	// sends unsolicited pongs, see Config.UnsolicitedPongInterval
+	pong *keepalive
+	// timeouts of connection, see Config.AllowClientTimeouts
+	idleTimeout    time.Duration
+	sessionTimeout time.Duration
+
+	// flow control, nil unless pausing is enabled
+	flow *flow
+	// messages not acknowledged by client, nil unless reliable delivery is enabled
+	reliable *resendBuffer
+	// bytes buffered by session, nil unless Config.MaxSessionBufferBytes is set
+	budget *budget
+	// response messages not sent yet, nil unless Config.MaxFramesInFlight is set
+	inflight *inflight
+}
+
+func newSession(c *Config, req *http.Request, ws *websocket.Conn, conn net.Conn, cancel context.CancelFunc) *session {
+	if c.LengthPrefixed || c.Multiplex || c.Reliable {
+		ws.PayloadType = websocket.BinaryFrame
+	}
+	if c.MaxPayloadBytes > 0 {
+		ws.MaxPayloadBytes = c.MaxPayloadBytes
+	}
+	s := &session{c: c, req: req, ws: ws, conn: conn, cancel: cancel, start: time.Now()}
+	if c.ConnectionLabels != nil {
+		c.hook(s, "ConnectionLabels", func() { s.labels = c.ConnectionLabels(req) })
+	}
+	s.log = newLabeledLogger(s.labels)
+	s.idleTimeout, s.sessionTimeout = c.timeouts(req)
+	if c.MaxSessionBufferBytes > 0 {
+		s.budget = newBudget(c.MaxSessionBufferBytes)
+	}
+	if c.PauseMessage != "" {
+		s.flow = newFlow(c.MaxPauseBuffer, s.budget)
+	}
+	if c.MaxFramesInFlight > 0 {
+		s.inflight = newInflight(c.MaxFramesInFlight)
+	}
+	return s
+}
+
+// metric reports measurement if Config.Metrics is set.
+// Extra labels are added to labels of session.
+func (s *session) metric(name string, value float64, extra map[string]string) {
+	if s.c.Metrics == nil {
+		return
+	}
+	labels := make(map[string]string, len(s.labels)+len(extra)+1)
+	for k, v := range s.labels {
+		labels[k] = v
+	}
+	for k, v := range extra {
+		labels[k] = v
+	}
+	labels[LabelPath] = s.req.URL.Path
+	s.c.hook(s, "Metrics", func() { s.c.Metrics(Metric{Name: name, Value: value, Labels: labels}) })
+}
+
+// watchOutput reports backends producing no output within Config.NoOutputThreshold
+// and closes session if backend produced no output within Config.FirstByteTimeout.
+func (s *session) watchOutput() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.c.NoOutputThreshold > 0 {
+		s.noOutput = time.AfterFunc(s.c.NoOutputThreshold, func() {
+			s.log.Debugf("shaxbee/go-wsproxy: No output from backend %s within %s, handler might not be streaming", s.req.URL.Path, s.c.NoOutputThreshold)
+			s.metric(MetricNoOutput, 1, nil)
+		})
+	}
+	if s.c.FirstByteTimeout > 0 {
+		s.firstByte = time.AfterFunc(s.c.FirstByteTimeout, func() {
+			s.log.Debugf("shaxbee/go-wsproxy: No output from backend %s within %s, closing", s.req.URL.Path, s.c.FirstByteTimeout)
+			s.closeWith(s.c.firstByteCloseCode(), closeReasonFirstByte, wrapError(ErrBackendFailed, fmt.Errorf("no output within %s", s.c.FirstByteTimeout)))
+			s.cancel()
+		})
+	}
+}
+
+// setRequestID records request ID propagated to backend.
+func (s *session) setRequestID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.RequestID = id
+}
+
+// wroteOutput records backend producing output.
+func (s *session) wroteOutput() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.noOutput != nil {
+		s.noOutput.Stop()
+		s.noOutput = nil
+	}
+	if s.firstByte != nil {
+		s.firstByte.Stop()
+		s.firstByte = nil
+	}
+}
+
+// startTimers arms idle and session timeouts if configured.
+func (s *session) startTimers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.idleTimeout > 0 {
+		s.idle = time.AfterFunc(s.idleTimeout, func() {
+			s.close(closeReasonIdle, nil)
+			s.cancel()
+		})
+	}
+	if s.sessionTimeout > 0 {
+		s.timeout = time.AfterFunc(s.sessionTimeout, func() {
+			s.close(closeReasonTimeout, nil)
+			s.cancel()
+		})
+	}
+	if s.c.FirstFrameTimeout > 0 {
+		s.firstFrame = time.AfterFunc(s.c.FirstFrameTimeout, func() {
+			s.abort(s.c.firstFrameCloseCode(), closeReasonFirstFrame, nil)
+		})
+	}
+	if s.c.UnsolicitedPongInterval > 0 {
+		s.pong = newKeepalive(s.c.UnsolicitedPongInterval, s.sendPong)
+	}
+}
+
+func (s *session) stopTimers() {
+	// Pong in progress is awaited without holding lock.
+	s.pong.stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+	if s.timeout != nil {
+		s.timeout.Stop()
+	}
+	if s.noOutput != nil {
+		s.noOutput.Stop()
+	}
+	if s.firstByte != nil {
+		s.firstByte.Stop()
+	}
+	if s.firstFrame != nil {
+		s.firstFrame.Stop()
+	}
+}
+
+// received records message received from websocket.
+func (s *session) received(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.MessagesIn++
+	s.stats.BytesIn += int64(n)
+	s.touch()
+	if s.firstFrame != nil {
+		s.firstFrame.Stop()
+		s.firstFrame = nil
+	}
+}
+
+// sent records message sent to websocket.
+func (s *session) sent(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.MessagesOut++
+	s.stats.BytesOut += int64(n)
+	s.touch()
+}
+
+// touch resets idle timeout on activity in either direction.
+// Must be called with mu held.
+func (s *session) touch() {
+	if s.idle != nil {
+		s.idle.Reset(s.idleTimeout)
+	}
+}
+
+// close records reason and error session was terminated with, first reason wins.
+func (s *session) close(reason string, err error) {
+	s.closeWith(CloseNormalClosure, reason, err)
+}
+
+// closeWith records close status code along with reason and error, first reason wins.
+func (s *session) closeWith(code int, reason string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stats.CloseReason == "" {
+		s.stats.CloseReason = reason
+		s.err = err
+		s.code = code
+	}
+}
+
+// shutdown closes session with CloseGoingAway unblocking pending reads.
+func (s *session) shutdown() {
+	s.abort(CloseGoingAway, closeReasonShutdown, nil)
+}
+
+// abort closes session with given status code unblocking pending reads.
+func (s *session) abort(code int, reason string, err error) {
+	s.closeWith(code, reason, err)
+	s.cancel()
+	s.interrupt()
+}
+
+// interrupt unblocks pending read from websocket.
+func (s *session) interrupt() {
+	if err := s.conn.SetReadDeadline(time.Now()); err != nil {
+		s.log.Debugf("shaxbee/go-wsproxy: Error interrupting read: %s", err)
+	}
+}
+
+// closing bounds remaining writes to websocket by Config.CloseTimeout.
+// Unblocks writes to unresponsive client.
+func (s *session) closing() {
+	if s.c.CloseTimeout <= 0 {
+		return
+	}
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.c.CloseTimeout)); err != nil {
+		s.log.Debugf("shaxbee/go-wsproxy: Error setting close deadline: %s", err)
+	}
+}
+
+// closeConn sends close frame with recorded status code and closes connection.
+func (s *session) closeConn() {
+	s.once.Do(func() {
+		s.closing()
+
+		s.mu.Lock()
+		code, text := s.code, s.text
+		s.mu.Unlock()
+		if code == 0 {
+			code = CloseNormalClosure
+		}
+
+		var err error
+		if code == CloseAbnormalClosure {
+			// Reserved status code must not be sent, connection is gone anyway.
+		} else if text != "" {
+			err = closeCodec.Send(s.ws, closePayload(code, text))
+		} else {
+			err = s.ws.WriteClose(code)
+		}
+		if err != nil {
+			s.log.Debugf("shaxbee/go-wsproxy: Error while closing websocket: %s", err)
+		} else if code != CloseAbnormalClosure && s.c.CloseHandshakeTimeout > 0 {
+			s.awaitClose()
+		} else if code != CloseAbnormalClosure {
+			s.linger()
+		}
+		s.conn.Close()
+	})
+}
+
+// linger half-closes connection and discards messages client sent before receiving close frame.
+// Closing connection with unread messages resets it, dropping close frame in flight.
+// Websocket must not be read concurrently.
+func (s *session) linger() {
+	s.mu.Lock()
+	received := s.peerClosed
+	s.mu.Unlock()
+	if received {
+		return
+	}
+
+	if cw, ok := s.conn.(interface{ CloseWrite() error }); ok {
+		// Fails if client reset connection already, drained read fails alike.
+		cw.CloseWrite()
+	}
+	end := time.Now().Add(closeLinger)
+	var buf bytes.Buffer
+	for {
+		deadline := time.Now().Add(closeLingerIdle)
+		if deadline.After(end) {
+			deadline = end
+		}
+		if err := s.conn.SetReadDeadline(deadline); err != nil {
+			s.log.Debugf("shaxbee/go-wsproxy: Error setting linger deadline: %s", err)
+			return
+		}
+		if _, _, err := receive(s.ws, &buf, s.c.MaxFragments); err != nil {
+			return
+		}
+	}
+}
+
+// awaitClose waits for client to acknowledge close frame within Config.CloseHandshakeTimeout.
+// Messages received meanwhile are discarded, websocket must not be read concurrently.
+func (s *session) awaitClose() {
+	s.mu.Lock()
+	received := s.peerClosed
+	s.mu.Unlock()
+	if received {
+		return
+	}
+
+	if err := s.conn.SetReadDeadline(time.Now().Add(s.c.CloseHandshakeTimeout)); err != nil {
+		s.log.Debugf("shaxbee/go-wsproxy: Error setting close handshake deadline: %s", err)
+		return
+	}
+	var buf bytes.Buffer
+	for {
+		_, _, err := receive(s.ws, &buf, s.c.MaxFragments)
+		if _, ok := err.(*CloseError); ok {
+			return
+		} else if err != nil {
+			s.log.Debugf("shaxbee/go-wsproxy: Client did not acknowledge close: %s", err)
+			return
+		}
+	}
+}
+
+// writeHeader handles status and headers written by backend.
+// Returns true if response body should be discarded.
+func (s *session) writeHeader(code int, h http.Header) bool {
+	s.metric(MetricBackendStatus, 1, map[string]string{LabelStatus: strconv.Itoa(code)})
+
+	if s.c.CloseCodeHeader != "" {
+		if v := h.Get(s.c.CloseCodeHeader); v != "" {
+			if cc, err := strconv.Atoi(v); err == nil && validCloseCode(cc) {
+				s.mu.Lock()
+				s.backendCode = cc
+				s.mu.Unlock()
+			} else {
+				s.log.Debugf("shaxbee/go-wsproxy: Invalid close code requested by backend: %q", v)
+			}
+		}
+	}
+
+	if s.c.FrameTypeFromContentType {
+		mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+		s.mu.Lock()
+		s.binary = mt == "application/octet-stream"
+		s.mu.Unlock()
+	}
+
+	if s.c.ErrorHeader != "" {
+		if msg := h.Get(s.c.ErrorHeader); msg != "" {
+			s.mu.Lock()
+			s.backendError = msg
+			s.mu.Unlock()
+			s.closeWith(CloseInternalServerErr, closeReasonBackendError, wrapError(ErrBackendFailed, errors.New(msg)))
+			s.cancel()
+			return true
+		}
+	}
+
+	if s.c.ForwardSetCookie {
+		if cookies := h["Set-Cookie"]; len(cookies) > 0 {
+			s.sendCookies(cookies)
+		}
+	}
+
+	if s.c.CloseReasonHeader != "" && (code < 200 || code >= 300) {
+		text := fmt.Sprintf("%d %s", code, http.StatusText(code))
+		if v := h.Get(s.c.CloseReasonHeader); v != "" {
+			text += ": " + v
+		}
+		s.mu.Lock()
+		s.text = text
+		s.mu.Unlock()
+	}
+
+	if code < 300 || code >= 400 || s.c.HandleRedirects == IgnoreRedirects {
+		return false
+	}
+
+	loc := h.Get("Location")
+	if loc == "" {
+		return false
+	}
+
+	switch s.c.HandleRedirects {
+	case CloseOnRedirect:
+		s.closeWith(CloseRedirect, closeReasonRedirect, nil)
+	case NotifyRedirect:
+		s.mu.Lock()
+		s.redirect = loc
+		s.mu.Unlock()
+		s.close(closeReasonRedirect, nil)
+	}
+	s.cancel()
+	return true
+}
+
+// sendRedirect notifies client about redirect.
+func (s *session) sendRedirect() {
+	s.mu.Lock()
+	loc := s.redirect
+	s.mu.Unlock()
+	if loc == "" {
+		return
+	}
+
+	b, err := s.c.jsonCodec().Marshal(struct {
+		Redirect string `json:"redirect"`
+	}{loc})
+	if err != nil {
+		s.log.Errorf("shaxbee/go-wsproxy: Error encoding redirect: %s", err)
+		return
+	}
+
+	if err := websocket.Message.Send(s.ws, string(b)); err != nil {
+		s.log.Debugf("shaxbee/go-wsproxy: Error while sending redirect: %s", err)
+	}
+}
+
+// sendCookies forwards cookies set by backend to client.
+func (s *session) sendCookies(cookies []string) {
+	b, err := s.c.jsonCodec().Marshal(struct {
+		SetCookie []string `json:"set_cookie"`
+	}{cookies})
+	if err != nil {
+		s.log.Errorf("shaxbee/go-wsproxy: Error encoding cookies: %s", err)
+		return
+	}
+
+	if err := websocket.Message.Send(s.ws, string(b)); err != nil {
+		s.log.Debugf("shaxbee/go-wsproxy: Error while sending cookies: %s", err)
+	}
+}
+
+// backendCloseCode returns close status code requested by backend, CloseNormalClosure by default.
+func (s *session) backendCloseCode() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.backendCode != 0 {
+		return s.backendCode
+	}
+	return CloseNormalClosure
+}
+
+// sendBackendError notifies client about error reported by backend.
+func (s *session) sendBackendError() {
+	s.mu.Lock()
+	msg := s.backendError
+	s.mu.Unlock()
+	if msg == "" {
+		return
+	}
+
+	b, err := s.c.jsonCodec().Marshal(struct {
+		Error string `json:"error"`
+	}{msg})
+	if err != nil {
+		s.log.Errorf("shaxbee/go-wsproxy: Error encoding backend error: %s", err)
+		return
+	}
+
+	if err := websocket.Message.Send(s.ws, string(b)); err != nil {
+		s.log.Debugf("shaxbee/go-wsproxy: Error while sending backend error: %s", err)
+	}
+}
+
+// sendMetadata sends first response record as message of form {"metadata": record}.
+// Returns ErrBadJSON if record is not valid JSON, send errors are left for listenWrite to handle.
+func (s *session) sendMetadata(m []byte) error {
+	if !s.c.jsonCodec().Valid(m) {
+		return ErrBadJSON
+	}
+	b, err := s.c.jsonCodec().Marshal(struct {
+		Metadata json.RawMessage `json:"metadata"`
+	}{m})
+	if err != nil {
+		return err
+	}
+
+	if err := websocket.Message.Send(s.ws, string(b)); err != nil {
+		s.log.Debugf("shaxbee/go-wsproxy: Error while sending metadata: %s", err)
+	}
+	return nil
+}
+
+// sendReconnect tells client to reconnect if session is closed by shutdown, see Config.ReconnectMessage.
+func (s *session) sendReconnect() {
+	if s.c.ReconnectMessage == "" {
+		return
+	}
+	s.mu.Lock()
+	shutdown := s.stats.CloseReason == closeReasonShutdown
+	s.mu.Unlock()
+	if !shutdown {
+		return
+	}
+
+	if err := websocket.Message.Send(s.ws, s.c.ReconnectMessage); err != nil {
+		s.log.Debugf("shaxbee/go-wsproxy: Error while sending reconnect message: %s", err)
+	}
+}
+
+// closeReceived records close frame received from client.
+func (s *session) closeReceived(ce *CloseError) {
+	s.closeWith(ce.Code, closeReasonClient, nil)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.peerClosed = true
+	if s.stats.CloseReason == closeReasonClient {
+		s.stats.CloseText = ce.Text
+	}
+}
+
+// fail records websocket transport failure.
+func (s *session) fail(err error) {
+	s.close(closeReasonError, err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failed = true
+}
+
+// overflow closes session which exceeded Config.MaxSessionBufferBytes.
+func (s *session) overflow() {
+	s.log.Debugf("shaxbee/go-wsproxy: Session buffer limit exceeded")
+	s.closeWith(CloseMessageTooBig, closeReasonBufferLimit, ErrSessionBufferFull)
+	s.cancel()
+}
+
+// skipInvalid reports whether invalid message should be skipped according to Config.ErrorPolicy.
+func (s *session) skipInvalid(err error) bool {
+	if s.c.ErrorPolicy != SkipInvalidMessages {
+		return false
+	}
+	s.log.Debugf("shaxbee/go-wsproxy: Skipped invalid message: %s", err)
+	return true
+}
+
+func (s *session) isFailed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.failed
+}
+
+func (s *session) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// snapshot returns current session stats.
+func (s *session) snapshot() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.stats
+	st.Duration = time.Since(s.start)
+	st.CloseCode = s.code
+	return st
+}
+
+func (s *session) sendSummary() {
+	b, err := s.c.jsonCodec().Marshal(struct {
+		Summary Stats `json:"summary"`
+	}{s.snapshot()})
+	if err != nil {
+		s.log.Errorf("shaxbee/go-wsproxy: Error encoding session summary: %s", err)
+		return
+	}
+
+	if err := websocket.Message.Send(s.ws, string(b)); err != nil {
+		s.log.Debugf("shaxbee/go-wsproxy: Error while sending session summary: %s", err)
+	}
+}
+
+func (s *session) listenRead(ctx context.Context, w *bufio.Writer) {
+	defer s.cancel()
+
+	// backend stopped reading request, messages are discarded
+	discard := false
+	// message buffer reused across reads
+	var buf bytes.Buffer
+	// number of messages received
+	n := 0
+	// bytes forwarded to request body
+	var total int64
+
+	// handles error of writing request, returns false once session should end
+	check := func(err error) bool {
+		// Buffered write fails same as flush once request is closed.
+		if err == io.ErrClosedPipe && s.c.OnBackendDone == DiscardAfterBackendDone {
+			s.log.Debugf("shaxbee/go-wsproxy: Request closed, discarding messages")
+			discard = true
+		} else if err == io.ErrClosedPipe || (err != nil && ctx.Err() != nil) {
+			// request closed by handler or during teardown
+			s.log.Debugf("shaxbee/go-wsproxy: Request closed while writing: %s", err)
+			s.close(closeReasonRequest, nil)
+			return false
+		} else if err != nil {
+			s.log.Errorf("shaxbee/go-wsproxy: Error while writing request: %s", err)
+			s.close(closeReasonError, wrapError(ErrBackendFailed, err))
+			return false
+		}
+		return true
+	}
+
+	// Messages received back to back are flushed together once no further message is buffered.
+	batched := !s.c.FlushEachInboundFrame && s.inbound != nil
+	if batched {
+		defer func() {
+			if !discard && w.Buffered() > 0 {
+				w.Flush()
+			}
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			if batched && !discard && w.Buffered() > 0 && s.inbound.Buffered() == 0 && !check(w.Flush()) {
+				return
+			}
+
+			pt, m, err := receive(s.ws, &buf, s.c.MaxFragments)
+			if ce, ok := err.(*CloseError); ok {
+				s.closeReceived(ce)
+				return
+			} else if err == io.EOF {
+				s.close(closeReasonClient, nil)
+				return
+			} else if err == websocket.ErrFrameTooLarge {
+				s.log.Debugf("shaxbee/go-wsproxy: Message too large")
+				s.closeWith(CloseMessageTooBig, closeReasonError, err)
+				return
+			} else if ctx.Err() != nil {
+				// websocket closed during teardown
+				return
+			} else if isClientAborted(err) {
+				s.clientAborted(err)
+				return
+			} else if err != nil {
+				s.log.Errorf("shaxbee/go-wsproxy: Error while reading from websocket: %s", err)
+				s.fail(err)
+				return
+			}
+			n++
+			if s.c.MaxMessagesPerSession > 0 && n > s.c.MaxMessagesPerSession {
+				s.closeWith(s.c.limitCloseCode(), closeReasonLimit, nil)
+				return
+			}
+			s.received(len(m))
+
+			if s.c.ValidateUTF8 && pt == websocket.TextFrame && !utf8.Valid(m) {
+				s.log.Debugf("shaxbee/go-wsproxy: Text message is not valid UTF-8")
+				s.closeWith(CloseInvalidFramePayloadData, closeReasonError, ErrInvalidUTF8)
+				return
+			}
+
+			if s.reliable != nil && pt == websocket.BinaryFrame {
+				seq, _, err := DecodeSequence(m)
+				if err != nil && s.skipInvalid(err) {
+					continue
+				} else if err != nil {
+					s.log.Errorf("shaxbee/go-wsproxy: Invalid acknowledgement: %s", err)
+					s.close(closeReasonError, err)
+					return
+				}
+				s.budget.release(s.reliable.ack(seq))
+				continue
+			}
+
+			if s.c.PauseMessage != "" && string(m) == s.c.PauseMessage {
+				s.flow.pause()
+				continue
+			} else if s.c.ResumeMessage != "" && string(m) == s.c.ResumeMessage {
+				if err := s.flow.resume(s.deliver); err != nil {
+					s.log.Debugf("shaxbee/go-wsproxy: Error while writing to websocket: %s", err)
+					s.fail(err)
+					return
+				}
+				continue
+			}
+
+			if !s.frameTypeMatches(pt) {
+				if s.c.OnFrameTypeMismatch == CloseOnMismatchedFrame {
+					s.closeWith(CloseUnsupportedData, closeReasonError, ErrFrameTypeMismatch)
+					return
+				}
+				s.log.Debugf("shaxbee/go-wsproxy: Dropped message with unexpected frame type %d", pt)
+				continue
+			}
+
+			if discard || !s.simulate(ctx) {
+				continue
+			}
+
+			total += int64(len(m))
+			if s.c.MaxRequestBodyBytes > 0 && total > s.c.MaxRequestBodyBytes {
+				s.closeWith(CloseMessageTooBig, closeReasonBodyLimit, nil)
+				return
+			}
+
+			err = s.writeRecord(w, m)
+			if err == ErrBadRecord && s.skipInvalid(err) {
+				continue
+			} else if err == ErrBadRecord {
+				s.log.Errorf("shaxbee/go-wsproxy: Invalid message: %s", err)
+				s.close(closeReasonError, err)
+				return
+			} else if err == nil && !batched {
+				err = w.Flush()
+			}
+			if !check(err) {
+				return
+			}
+		}
+	}
+}
+
+func (s *session) listenWrite(ctx context.Context, r *bufio.Reader) {
+	// last record sent, used for deduplication
+	var last []byte
+	sentAny := false
+	// first record is sent as metadata, see Config.FirstLineIsMetadata
+	metadata := s.c.FirstLineIsMetadata
+
+	var ka *keepalive
+	if s.c.KeepaliveInterval > 0 {
+		ka = newKeepalive(s.c.KeepaliveInterval, s.sendKeepalive)
+		defer ka.stop()
+	}
+
+	next := s.records(r)
+	if s.c.FlushInterval > 0 {
+		next = newFlushReader(ctx, r, []byte(s.c.recordDelimiter()), s.c.FlushInterval).next
+	}
+	if s.c.CoalesceRecords > 0 {
+		next = newCoalescer(ctx, next, s.c.CoalesceRecords, s.c.CoalesceFlushInterval).next
+	}
+	if s.inflight != nil {
+		next = newPrefetcher(ctx, next, s.inflight).next
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			m, err := next()
+			if err == io.EOF && len(m) > 0 {
+				// Send final record without trailing newline, EOF is returned by next read.
+				err = nil
+			}
+			if err == io.EOF {
+				// Deliver buffered response before closing.
+				s.flow.wait(ctx)
+				if s.c.OnBackendDone == CloseAfterBackendDone {
+					s.closeWith(s.backendCloseCode(), closeReasonBackend, nil)
+					s.cancel()
+				}
+				return
+			} else if err == io.ErrClosedPipe || (err != nil && ctx.Err() != nil) {
+				// response closed during teardown
+				s.log.Debugf("shaxbee/go-wsproxy: Response closed: %s", err)
+				return
+			} else if err == ErrBadJSON && s.skipInvalid(err) {
+				continue
+			} else if err != nil {
+				s.log.Errorf("shaxbee/go-wsproxy: Error while reading response: %s", err)
+				s.close(closeReasonError, wrapError(ErrBackendFailed, err))
+				s.cancel()
+				return
+			}
+
+			if metadata {
+				metadata = false
+				err := s.sendMetadata(m)
+				s.inflight.release()
+				if err == ErrBadJSON && s.skipInvalid(err) {
+					continue
+				} else if err != nil {
+					s.log.Errorf("shaxbee/go-wsproxy: Invalid response metadata: %s", err)
+					s.close(closeReasonError, wrapError(ErrBackendFailed, err))
+					s.cancel()
+					return
+				}
+				continue
+			}
+
+			if s.c.DedupeOutput {
+				if sentAny && bytes.Equal(m, last) {
+					s.inflight.release()
+					continue
+				}
+				last = append(last[:0], m...)
+				sentAny = true
+			}
+
+			if !s.simulate(ctx) {
+				s.inflight.release()
+				continue
+			}
+
+			if err := s.flow.write(ctx, m, s.deliver); err != nil && ctx.Err() == nil && isClientAborted(err) {
+				s.clientAborted(err)
+				return
+			} else if err != nil && (ctx.Err() != nil || isConnClosed(err)) {
+				// websocket closed during teardown or by client
+				s.log.Debugf("shaxbee/go-wsproxy: Websocket closed while writing: %s", err)
+				s.fail(err)
+				return
+			} else if err == ErrResendBufferFull {
+				s.log.Debugf("shaxbee/go-wsproxy: Client did not acknowledge messages")
+				s.closeWith(ClosePolicyViolation, closeReasonUnacked, err)
+				s.cancel()
+				return
+			} else if err == ErrSessionBufferFull {
+				s.overflow()
+				return
+			} else if err != nil {
+				s.log.Errorf("shaxbee/go-wsproxy: Error while writing to websocket: %s", err)
+				s.fail(err)
+				s.cancel()
+				return
+			}
+			ka.reset()
+		}
+	}
+}
+
+// sendKeepalive sends keepalive message, errors are left for listenWrite to handle.
+func (s *session) sendKeepalive() {
+	msg := s.c.KeepaliveMessage
+	if msg == "" {
+		msg = defaultKeepaliveMessage
+	}
+
+	if err := websocket.Message.Send(s.ws, msg); err != nil {
+		s.log.Debugf("shaxbee/go-wsproxy: Error while sending keepalive: %s", err)
+	}
+}
+
+// sendPong sends unsolicited pong, errors are left for listenWrite to handle.
+func (s *session) sendPong() {
+	if err := pongCodec.Send(s.ws, []byte{}); err != nil {
+		s.log.Debugf("shaxbee/go-wsproxy: Error while sending pong: %s", err)
+	}
+}
+
+// writeRecord writes message received from websocket to request using configured framing.
+func (s *session) writeRecord(w *bufio.Writer, m []byte) error {
+	if s.c.LengthPrefixed {
+		if !validRecord(m) {
+			return ErrBadRecord
+		}
+		_, err := w.Write(m)
+		return err
+	}
+
+	w.Write(m)
+	_, err := w.WriteString(s.c.recordDelimiter())
+	return err
+}
+
+// frameTypeMatches reports whether message of payload type pt is expected by Config.OnFrameTypeMismatch.
+func (s *session) frameTypeMatches(pt byte) bool {
+	if s.c.OnFrameTypeMismatch == ConvertMismatchedFrames {
+		return true
+	}
+	if s.c.LengthPrefixed || s.c.Multiplex {
+		return pt == websocket.BinaryFrame
+	}
+	return pt == websocket.TextFrame
+}
+
+// readRecord reads response record using configured framing.
+func (s *session) readRecord(r *bufio.Reader) ([]byte, error) {
+	if s.c.LengthPrefixed {
+		return readRecord(r)
+	}
+	if s.c.JSONAwareFraming {
+		return readJSON(r, s.c.jsonCodec().Valid)
+	}
+	return readDelimited(r, []byte(s.c.recordDelimiter()))
+}
+
+// records returns function reading response records from r.
+func (s *session) records(r *bufio.Reader) func() ([]byte, error) {
+	if s.c.SplitFunc != nil {
+		return newSplitReader(r, s.c.SplitFunc).next
+	}
+	return func() ([]byte, error) { return s.readRecord(r) }
+}
+
+// isConnClosed reports whether err was caused by connection closed by either side.
+func isConnClosed(err error) bool {
+	return isConnReset(err) || strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// isConnReset reports whether err was caused by peer resetting connection.
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// isClientAborted reports whether err was caused by client resetting connection.
+func isClientAborted(err error) bool {
+	return isConnReset(err) || errors.Is(err, syscall.ECONNABORTED)
+}
+
+// clientAborted records connection reset by client.
+func (s *session) clientAborted(err error) {
+	s.log.Debugf("shaxbee/go-wsproxy: Client aborted connection: %s", err)
+	s.closeWith(CloseAbnormalClosure, closeReasonAborted, wrapError(ErrClientAborted, err))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failed = true
+}
+
+// deliver sends record, records it in stats and releases its slot, see Config.MaxFramesInFlight.
+func (s *session) deliver(m []byte) error {
+	defer s.inflight.release()
+
+	if err := s.send(m); err != nil {
+		return err
+	}
+	s.sent(len(m))
+	return nil
+}
+
+// send sends record as single frame.
+// Payload type is binary if length prefixed framing is used or response content type is binary
+// and text otherwise.
+// Errors are not retried, websocket retains first write error and frame might be partially written.
+func (s *session) send(m []byte) error {
+	defer s.blocked(time.Now())
+
+	if s.reliable != nil {
+		if err := s.budget.reserve(seqPrefixLen + len(m)); err != nil {
+			return err
+		}
+		b, err := s.reliable.push(m)
+		if err != nil {
+			s.budget.release(seqPrefixLen + len(m))
+			return err
+		}
+		m = b
+	}
+	if s.c.FrameTypeFromContentType {
+		s.mu.Lock()
+		binary := s.binary
+		s.mu.Unlock()
+		if binary {
+			return websocket.Message.Send(s.ws, m)
+		}
+		return websocket.Message.Send(s.ws, string(m))
+	}
+	_, err := s.ws.Write(m)
+	return err
+}
+
+// blocked records time spent sending message since start.
+func (s *session) blocked(start time.Time) {
+	d := time.Since(start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.WriteBlocked += d
+}
+
+// resume sends session ID followed by messages not acknowledged before reconnect.
+func (s *session) resume() error {
+	if s.reliable == nil {
+		return nil
+	}
+
+	if _, err := s.ws.Write(EncodeSequence(0, []byte(s.reliable.id))); err != nil {
+		return err
+	}
+	for _, b := range s.reliable.pending() {
+		// Messages of resumed session count against limit of this connection.
+		if err := s.budget.reserve(len(b)); err != nil {
+			return err
+		}
+		if _, err := s.ws.Write(b); err != nil {
+			return err
+		}
+		s.sent(len(b) - seqPrefixLen)
+	}
+	return nil
+}
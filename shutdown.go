@@ -0,0 +1,95 @@
+package wsproxy
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown closes active websocket sessions with CloseGoingAway and rejects further upgrades.
+// Waits until sessions end or ctx is done, in which case remaining connections are closed and ctx error returned.
+func (wp *WebSocketProxy) Shutdown(ctx context.Context) error {
+	wp.mu.Lock()
+	wp.closing = true
+	for s := range wp.active {
+		s.shutdown()
+	}
+	wp.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		wp.mu.Lock()
+		n := len(wp.active)
+		wp.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			wp.mu.Lock()
+			for s := range wp.active {
+				s.conn.Close()
+			}
+			wp.mu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// RegisterWithServer shuts down proxy once srv is shutting down, see http.Server.RegisterOnShutdown.
+// Sets srv.ReadHeaderTimeout to Config.HandshakeTimeout unless set already,
+// bounding read of handshake request along with any other request served by srv.
+func (wp *WebSocketProxy) RegisterWithServer(srv *http.Server) {
+	if srv.ReadHeaderTimeout == 0 {
+		srv.ReadHeaderTimeout = wp.c.HandshakeTimeout
+	}
+	srv.RegisterOnShutdown(func() {
+		if err := wp.Shutdown(context.Background()); err != nil {
+			logger.Errorf("shaxbee/go-wsproxy: Error shutting down: %s", err)
+		}
+	})
+}
+
+// SetAcceptingUpgrades toggles accepting new websocket connections.
+// While disabled, upgrades are refused with 503 Service Unavailable and sessions in progress are kept alive.
+// Non-websocket requests are still passed through.
+func (wp *WebSocketProxy) SetAcceptingUpgrades(accept bool) {
+	var v int32
+	if !accept {
+		v = 1
+	}
+	atomic.StoreInt32(&wp.refusing, v)
+}
+
+// track registers active session.
+// Returns false if proxy is shutting down.
+func (wp *WebSocketProxy) track(s *session) bool {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	if wp.closing {
+		return false
+	}
+	wp.active[s] = struct{}{}
+	return true
+}
+
+func (wp *WebSocketProxy) untrack(s *session) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	delete(wp.active, s)
+}
+
+func (wp *WebSocketProxy) isClosing() bool {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	return wp.closing
+}
@@ -0,0 +1,174 @@
+package wsproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestShutdown(t *testing.T) {
+	for _, c := range []Config{{}, {ReadToken: true}} {
+		started := make(chan struct{}, 1)
+		wp := New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			io.Copy(ioutil.Discard, r.Body)
+		}))
+		ts := httptest.NewServer(wp)
+		defer ts.Close()
+
+		ws := dial(t, ts)
+		defer ws.Close()
+		if !c.ReadToken {
+			<-started
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, wp.Shutdown(ctx))
+		assert.Equal(t, CloseGoingAway, receiveClose(t, ws))
+
+		resp := handshake(t, ts, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+func TestShutdownMidStream(t *testing.T) {
+	l, restore := captureLogger()
+	defer restore()
+
+	echoed := make(chan struct{}, 1)
+	wp := New(Config{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		br := bufio.NewReader(r.Body)
+		for {
+			m, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if _, err := io.WriteString(w, m); err != nil {
+				return
+			}
+			select {
+			case echoed <- struct{}{}:
+			default:
+			}
+		}
+	}))
+	ts := httptest.NewServer(wp)
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	// Client keeps sending messages exceeding request buffer while proxy shuts down.
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for websocket.Message.Send(ws, strings.Repeat("x", 8192)) == nil {
+		}
+	}()
+	<-echoed
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, wp.Shutdown(ctx))
+	assert.Equal(t, CloseGoingAway, receiveClose(t, ws))
+	ws.Close()
+	<-sent
+
+	assert.Empty(t, l.Errors())
+}
+
+func TestReconnectMessage(t *testing.T) {
+	started := make(chan struct{})
+	wp := New(Config{ReconnectMessage: `{"reconnect":true}`}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	ts := httptest.NewServer(wp)
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, wp.Shutdown(ctx))
+
+	var m string
+	if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+		assert.Equal(t, `{"reconnect":true}`, m)
+	}
+	assert.Equal(t, CloseGoingAway, receiveClose(t, ws))
+}
+
+func TestRegisterWithServer(t *testing.T) {
+	started := make(chan struct{})
+	wp := New(Config{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: wp}
+	wp.RegisterWithServer(srv)
+	go srv.Serve(l)
+
+	url := "http://" + l.Addr().String()
+	ws, err := websocket.Dial(strings.Replace(url, "http://", "ws://", 1), "", url)
+	require.NoError(t, err)
+	defer ws.Close()
+	<-started
+
+	require.NoError(t, srv.Shutdown(context.Background()))
+	assert.Equal(t, CloseGoingAway, receiveClose(t, ws))
+}
+
+func TestSetAcceptingUpgrades(t *testing.T) {
+	wp := New(Config{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		br := bufio.NewReader(r.Body)
+		for {
+			m, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			io.WriteString(w, m)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	ts := httptest.NewServer(wp)
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	wp.SetAcceptingUpgrades(false)
+	resp := handshake(t, ts, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	require.NoError(t, websocket.Message.Send(ws, "foo"))
+	var m string
+	if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+		assert.Equal(t, "foo\n", m)
+	}
+
+	wp.SetAcceptingUpgrades(true)
+	resp = handshake(t, ts, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+}
@@ -0,0 +1,98 @@
+package wsproxy
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// acceptsSSE reports whether request asks for server-sent events.
+func acceptsSSE(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// serveSSE streams newline delimited response of handler as server-sent events.
+func serveSSE(h http.Handler, w http.ResponseWriter, r *http.Request) {
+	sw := &sseWriter{ResponseWriter: w}
+	h.ServeHTTP(sw, r)
+	sw.close()
+}
+
+// sseWriter sends each line of successful response as data event.
+// Responses with non-2xx status are forwarded unchanged.
+type sseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	sse         bool
+	// incomplete line
+	buf []byte
+}
+
+func (sw *sseWriter) WriteHeader(code int) {
+	if sw.wroteHeader {
+		return
+	}
+	sw.wroteHeader = true
+
+	if code >= 200 && code < 300 {
+		sw.sse = true
+		h := sw.Header()
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+		h.Del("Content-Length")
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *sseWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if !sw.sse {
+		return sw.ResponseWriter.Write(b)
+	}
+
+	sw.buf = append(sw.buf, b...)
+	i := 0
+	for {
+		n := bytes.IndexByte(sw.buf[i:], '\n')
+		if n < 0 {
+			break
+		}
+		if err := sw.event(sw.buf[i : i+n]); err != nil {
+			return 0, err
+		}
+		i += n + 1
+	}
+	sw.buf = sw.buf[:copy(sw.buf, sw.buf[i:])]
+
+	sw.Flush()
+	return len(b), nil
+}
+
+func (sw *sseWriter) event(line []byte) error {
+	if len(line) == 0 {
+		return nil
+	}
+
+	b := make([]byte, 0, len(line)+8)
+	b = append(b, "data: "...)
+	b = append(b, line...)
+	b = append(b, '\n', '\n')
+	_, err := sw.ResponseWriter.Write(b)
+	return err
+}
+
+func (sw *sseWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close sends remaining incomplete line.
+func (sw *sseWriter) close() {
+	if sw.sse && len(sw.buf) > 0 {
+		sw.event(sw.buf)
+		sw.Flush()
+	}
+}
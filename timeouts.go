@@ -0,0 +1,63 @@
+package wsproxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// IdleTimeoutHeader is a handshake header proposing IdleTimeout of connection such as "30s",
+	// see Config.AllowClientTimeouts.
+	IdleTimeoutHeader = "X-WS-Idle-Timeout"
+	// SessionTimeoutHeader is a handshake header proposing MaxSessionDuration of connection.
+	SessionTimeoutHeader = "X-WS-Session-Timeout"
+)
+
+// clientTimeout returns timeout proposed by client in header h, zero if none was proposed.
+// Timeout must not exceed MaxClientTimeout, or configured timeout def if MaxClientTimeout is zero.
+func (c *Config) clientTimeout(r *http.Request, h string, def time.Duration) (time.Duration, error) {
+	v := r.Header.Get(h)
+	if v == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", h, v)
+	}
+	max := c.MaxClientTimeout
+	if max == 0 {
+		max = def
+	}
+	if d < c.MinClientTimeout || (max > 0 && d > max) {
+		return 0, fmt.Errorf("%s %s out of bounds", h, d)
+	}
+	return d, nil
+}
+
+// checkClientTimeouts validates timeouts proposed by client.
+func (c *Config) checkClientTimeouts(r *http.Request) error {
+	if _, err := c.clientTimeout(r, IdleTimeoutHeader, c.IdleTimeout); err != nil {
+		return err
+	}
+	_, err := c.clientTimeout(r, SessionTimeoutHeader, c.MaxSessionDuration)
+	return err
+}
+
+// timeouts returns idle and session timeouts of connection.
+// Configured timeouts are used unless client proposed valid ones.
+func (c *Config) timeouts(r *http.Request) (idle, session time.Duration) {
+	idle, session = c.IdleTimeout, c.MaxSessionDuration
+	if !c.AllowClientTimeouts {
+		return idle, session
+	}
+
+	if d, err := c.clientTimeout(r, IdleTimeoutHeader, c.IdleTimeout); err == nil && d > 0 {
+		idle = d
+	}
+	if d, err := c.clientTimeout(r, SessionTimeoutHeader, c.MaxSessionDuration); err == nil && d > 0 {
+		session = d
+	}
+	return idle, session
+}
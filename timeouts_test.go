@@ -0,0 +1,82 @@
+package wsproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestClientTimeouts(t *testing.T) {
+	c := Config{
+		SendSessionSummary:  true,
+		IdleTimeout:         time.Hour,
+		AllowClientTimeouts: true,
+		MinClientTimeout:    10 * time.Millisecond,
+		MaxClientTimeout:    time.Second,
+	}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	})
+	defer ts.Close()
+
+	conf, err := websocket.NewConfig(strings.Replace(ts.URL, "http://", "ws://", 1), ts.URL)
+	require.NoError(t, err)
+	conf.Header.Set(IdleTimeoutHeader, "50ms")
+	ws, err := websocket.DialConfig(conf)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	var s struct {
+		Summary Stats `json:"summary"`
+	}
+	require.NoError(t, ws.SetReadDeadline(time.Now().Add(time.Second)))
+	if assert.NoError(t, websocket.JSON.Receive(ws, &s)) {
+		assert.Equal(t, closeReasonIdle, s.Summary.CloseReason)
+	}
+
+	wg.Wait()
+}
+
+func TestClientTimeoutsOutOfBounds(t *testing.T) {
+	c := Config{AllowClientTimeouts: true, MinClientTimeout: time.Second, MaxClientTimeout: time.Minute}
+	ts, _ := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler invoked.")
+	})
+	defer ts.Close()
+
+	for _, h := range []http.Header{
+		{IdleTimeoutHeader: {"10ms"}},
+		{SessionTimeoutHeader: {"1h"}},
+		{IdleTimeoutHeader: {"dummy"}},
+	} {
+		r := handshake(t, ts, h)
+		r.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	}
+}
+
+func TestClientTimeoutsDefaultBounds(t *testing.T) {
+	c := Config{AllowClientTimeouts: true, IdleTimeout: time.Minute, MaxSessionDuration: time.Hour}
+	ts, _ := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler invoked.")
+	})
+	defer ts.Close()
+
+	// Client must not extend configured timeouts if MaxClientTimeout is not set.
+	for _, h := range []http.Header{
+		{IdleTimeoutHeader: {"2m"}},
+		{SessionTimeoutHeader: {"87600h"}},
+	} {
+		r := handshake(t, ts, h)
+		r.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	}
+}
@@ -2,13 +2,22 @@ package wsproxy
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/golang/glog"
-
-	"golang.org/x/net/context"
 	"golang.org/x/net/websocket"
 )
 
@@ -16,139 +25,1497 @@ import (
 type WebSocketProxy struct {
 	c Config
 	h http.Handler
+	// resend buffers of disconnected reliable sessions
+	resumable *resumeRegistry
+
+	mu sync.Mutex
+	// sessions in progress
+	active map[*session]struct{}
+	// set once Shutdown is called
+	closing bool
+	// number of websocket connections per client IP
+	perIP map[string]int
+
+	// non-zero while new upgrades are refused, accessed atomically
+	refusing int32
+	// slots of running handlers, nil unless Config.MaxConcurrentHandlers is set
+	handlers chan struct{}
+}
+
+// TokenContextKey is a context key for token read from first message when Config.ReadToken is set.
+// Associated value is of type string.
+var TokenContextKey = &contextKey{"token"}
+
+type contextKey struct {
+	name string
 }
 
+func (k *contextKey) String() string { return "shaxbee/go-wsproxy context value " + k.name }
+
 // Config contains parameters for WebSocketProxy
 type Config struct {
 	// Expect first message to contain OAuth token.
-	// Provided token will be forwarder to handler in Authorization header.
+	// Provided token will be forwarder to handler in Authorization header
+	// and stored in request context under TokenContextKey.
+	// Token may be sent in either text or binary frame.
 	ReadToken bool
+	// Close websocket with AuthFailureCloseCode if token read from first message is empty.
+	// Otherwise Authorization header is omitted for empty token.
+	RequireToken bool
 	// Rewrite GET method used in websocket connection to provided value.
 	// Ignored if empty.
 	RewriteMethod string
+	// Select method of backend request for websocket connection.
+	// Original method is used if empty string is returned.
+	// Takes precedence over RewriteMethod.
+	RewriteMethodFor func(*http.Request) string
+	// Send session summary as last message before closing websocket.
+	// Summary is a JSON object of form {"summary": Stats}.
+	// Summary is not sent if websocket transport failed.
+	SendSessionSummary bool
+	// Handling of messages received after backend handler finished.
+	// Websocket is closed once response is forwarded by default.
+	OnBackendDone BackendDonePolicy
+	// Configure connection underlying websocket after upgrade.
+	// Connection is *net.TCPConn or *tls.Conn for most servers.
+	// Safe to set socket options such as SetNoDelay, SetKeepAlive, SetKeepAlivePeriod
+	// and buffer sizes. Connection must not be read, written, closed or have deadlines set.
+	// Returning error closes the websocket.
+	ConfigureConn func(net.Conn) error
+	// Reject upgrade with 426 Upgrade Required unless client requests websocket version 13.
+	RequireVersion13 bool
+	// Close websocket if no message was sent or received within duration.
+	// Ignored if zero.
+	IdleTimeout time.Duration
+	// Close websocket once session lasted for duration regardless of activity.
+	// Ignored if zero.
+	MaxSessionDuration time.Duration
+	// Abort websocket handshake not completed within duration.
+	// Handshake request is read by http.Server before proxy is invoked,
+	// it is bounded only once proxy is registered with server, see RegisterWithServer.
+	// Ignored if zero.
+	HandshakeTimeout time.Duration
+	// Select handler for request, overriding handler passed to New.
+	// Request is handled by NotFoundHandler if nil handler is returned.
+	HandlerFor func(*http.Request) http.Handler
+	// Maximum number of frames fragmented message can consist of.
+	// Fragmented messages are reassembled before being forwarded.
+	// Ignored if zero.
+	MaxFragments int
+	// Frame records with 4-byte big-endian length prefix instead of newline.
+	// Every websocket message and every record in request and response
+	// consists of length prefix followed by payload, see WriteRecord and ReadRecord.
+	// Messages are sent as binary frames.
+	LengthPrefixed bool
+	// Start tracing span for websocket session.
+	// Returned context is used as base context of backend request,
+	// returned function is invoked with session stats and terminating error once session ends.
+	StartSpan func(context.Context, *http.Request) (context.Context, func(Stats, error))
+	// Headers written on handshake response.
+	// Sec-WebSocket-Protocol selects subprotocol, other handshake headers are ignored.
+	UpgradeResponseHeaders http.Header
+	// Read OAuth token from subprotocols offered by client in form ["bearer", token].
+	// Provided token is forwarded same as with ReadToken and "bearer" subprotocol is selected.
+	// Handshake is rejected if token is not provided.
+	TokenFromSubprotocol bool
+	// Handling of redirect responses from backend.
+	// Redirects are ignored by default.
+	HandleRedirects RedirectPolicy
+	// Skip records identical to previously sent one.
+	// Changes delivery semantics, client must not rely on receiving every record.
+	// With Multiplex records are compared within their stream.
+	DedupeOutput bool
+	// Send KeepaliveMessage if no record was sent within interval.
+	// Keepalive is postponed by every record sent, active sessions receive no keepalives.
+	// Ignored if zero.
+	KeepaliveInterval time.Duration
+	// Message sent as keepalive, defaults to "{}".
+	KeepaliveMessage string
+	// Close websocket once client sends more messages than limit.
+	// Ignored if zero.
+	MaxMessagesPerSession int
+	// Close status code sent when MaxMessagesPerSession is exceeded.
+	// Defaults to ClosePolicyViolation.
+	MaxMessagesCloseCode int
+	// Invoked with session stats and terminating error once websocket is closed.
+	// Stats include close status code and reason sent by client.
+	OnDisconnect func(*http.Request, Stats, error)
+	// Report metrics measured during session.
+	Metrics func(Metric)
+	// Report MetricNoOutput if backend produced no output within duration after dispatch.
+	// Ignored if zero.
+	NoOutputThreshold time.Duration
+	// Dispatch backend before upgrade and complete handshake only once backend responds with 2xx status.
+	// Otherwise backend response is returned as handshake response.
+	// Backend is dispatched before handshake is validated, ReadToken is not supported.
+	DeferUpgradeUntilBackendResponds bool
+	// Header propagating request ID to backend request.
+	// Request ID is generated if missing in websocket request and included in Stats.
+	RequestIDHeader string
+	// Generate request ID, defaults to random 128-bit hex string.
+	GenerateRequestID func() string
+	// Multiplex logical streams over websocket, each dispatched to separate backend request.
+	// Messages are binary and prefixed with stream ID, see EncodeStream.
+	// Request of stream is dispatched on first message and closed on empty message.
+	// Empty message is sent once response of stream ends, stream ID may be reused afterwards.
+	// Message sent to stream closed by client before its response ended is invalid, see ErrStreamClosed.
+	// Session summary, keepalives and redirect notifications are not sent.
+	Multiplex bool
+	// Close websocket with CloseMessageTooBig once total size of messages
+	// forwarded to request body exceeds limit. Ignored if zero.
+	MaxRequestBodyBytes int64
+	// Abandon writes to websocket not completed within timeout once session ends.
+	// Prevents teardown from blocking on client not reading. Ignored if zero.
+	CloseTimeout time.Duration
+	// Wait for client to acknowledge close frame within timeout before closing connection
+	// once session ends. Messages received meanwhile are discarded. Ignored if zero.
+	CloseHandshakeTimeout time.Duration
+	// Paths where ReadToken is skipped, matched exactly against request path.
+	PublicPaths []string
+	// Stream newline delimited response as server-sent events
+	// if request without upgrade accepts text/event-stream.
+	// Response with non-2xx status is forwarded unchanged. Not supported with LengthPrefixed.
+	EnableSSEFallback bool
+	// Message pausing sending of response to websocket, not forwarded to backend.
+	// Ignored with Multiplex.
+	PauseMessage string
+	// Message resuming sending of response paused by PauseMessage, not forwarded to backend.
+	ResumeMessage string
+	// Size of response in bytes buffered in memory while paused.
+	// Once exceeded backend is blocked on write until resumed.
+	MaxPauseBuffer int
+	// Number of response messages read ahead of writes to websocket, including messages
+	// buffered while paused. Once reached backend is blocked on write until messages are sent.
+	// Ignored if zero.
+	MaxFramesInFlight int
+	// Codec of JSON messages handled by proxy, defaults to StdJSONCodec.
+	JSONCodec JSONCodec
+	// Pass requests upgrading to protocol other than websocket to handler.
+	// Otherwise such requests are rejected with 501 Not Implemented.
+	PassthroughUpgrades bool
+	// Maximum size of message read from websocket, defaults to websocket.DefaultMaxPayloadBytes.
+	// Websocket is closed with CloseMessageTooBig if exceeded.
+	MaxPayloadBytes int
+	// Origins allowed to connect, rejected with 403 otherwise.
+	// Entries match origin host exactly or any subdomain if prefixed with "*.", excluding domain itself.
+	// Entries with port such as "example.com:8443" also match origin port, otherwise any port is allowed.
+	// Entries with scheme such as "https://example.com" also match origin scheme.
+	AllowedOrigins []string
+	// Number response messages and retain them until acknowledged by client for at-least-once delivery.
+	// Messages are sent as binary frames prefixed with 8-byte big-endian sequence number, see EncodeSequence.
+	// First message of each connection has sequence number 0 and contains session ID.
+	// Client acknowledges messages up to sequence number by sending binary frame containing only sequence number,
+	// text frames are forwarded to backend. Proxy messages such as summary are sent as text frames.
+	// Session is resumed by connecting with session ID in "resume" query parameter,
+	// unacknowledged messages are resent before response of new backend request.
+	// Not supported with LengthPrefixed and Multiplex.
+	Reliable bool
+	// Maximum number of unacknowledged messages, defaults to 256.
+	// Websocket is closed with ClosePolicyViolation if exceeded.
+	ResendBuffer int
+	// Retain unacknowledged messages of disconnected session for duration. Ignored if zero.
+	ResumeTimeout time.Duration
+	// Content-Type of backend request, omitted if empty.
+	RequestContentType string
+	// Parse first message read with ReadToken as JSON object mapping string fields to backend request headers.
+	// Keys are field names, values are header names.
+	// Websocket is closed with ClosePolicyViolation if message is not a valid object.
+	AuthEnvelope map[string]string
+	// Delimiter of request and response records such as "\r\n", defaults to newline.
+	// Ignored with LengthPrefixed.
+	RecordDelimiter string
+	// Response header signalling backend error, such as "X-Error".
+	// If set when response header is written, body is discarded,
+	// client receives message of form {"error": value} and websocket is closed with CloseInternalServerErr.
+	ErrorHeader string
+	// Reject websocket handshakes with headers exceeding limit with 431 Request Header Fields Too Large.
+	// Size is computed as in HTTP/1.1 wire format. Ignored if zero.
+	MaxHandshakeHeaderBytes int
+	// Enable simulated network conditions for testing clients. Not meant for production.
+	// Simulated options are ignored unless set.
+	ChaosMode bool
+	// Delay of every message in both directions.
+	SimulatedLatency time.Duration
+	// Upper bound of random delay added to SimulatedLatency.
+	SimulatedJitter time.Duration
+	// Probability of dropping message in range [0, 1]. Empty messages of Multiplex are never dropped.
+	SimulatedDropRate float64
+	// Invoked before request is handed off, upgraded is true if request is proxied as websocket session
+	// and false if it is passed through to handler as plain HTTP request.
+	// Requests rejected by proxy are not reported.
+	OnDisposition func(r *http.Request, upgraded bool)
+	// Forward negotiated websocket subprotocol to backend in header such as "X-WS-Protocol".
+	// Ignored with DeferUpgradeUntilBackendResponds as backend is dispatched before negotiation.
+	SubprotocolHeader string
+	// Reject websocket connections exceeding limit per client IP with 429 Too Many Requests.
+	// Client IP is taken from http.Request.RemoteAddr, rewrite it in middleware to honour forwarded headers.
+	// Ignored if zero.
+	MaxConnectionsPerIP int
+	// Header of non-2xx backend response, such as "X-Error-Message", sent as websocket close reason
+	// of form "404 Not Found: value". Status alone is sent if header is missing.
+	CloseReasonHeader string
+	// Response header carrying websocket close status code, such as "X-WS-Close-Code".
+	// Code is sent if websocket is closed once response is forwarded, see OnBackendDone.
+	// Reserved and out of range codes are ignored.
+	CloseCodeHeader string
+	// Read response as stream of JSON values, each sent as single message.
+	// Values may contain newlines, request records are still delimited by RecordDelimiter.
+	// Invalid JSON terminates session.
+	JSONAwareFraming bool
+	// Derive labels such as tenant or client version from websocket request.
+	// Labels are attached to metrics and log messages of connection, LabelPath takes precedence.
+	ConnectionLabels func(*http.Request) map[string]string
+	// Set X-Original-URI header of backend request to request URI of websocket request.
+	ForwardOriginalPath bool
+	// Send partial response record once it was buffered for duration without delimiter.
+	// Not supported with LengthPrefixed, JSONAwareFraming or Multiplex. Ignored if zero.
+	FlushInterval time.Duration
+	// Handling of panics in callbacks such as Metrics or OnDisconnect.
+	// Panics are not recovered by default.
+	HookPanicPolicy HookPanicPolicy
+	// Send response in binary frames if backend declares Content-Type application/octet-stream
+	// and in text frames otherwise.
+	// Not supported with LengthPrefixed, Multiplex or Reliable which always use binary frames.
+	FrameTypeFromContentType bool
+	// Validate token read with ReadToken or TokenFromSubprotocol before backend is dispatched.
+	// Websocket is closed with AuthFailureCloseCode if error is returned.
+	// With DeferUpgradeUntilBackendResponds upgrade is refused with 401 Unauthorized instead.
+	// Token is validated as read, before AuthEnvelope mapping. Ignored for PublicPaths.
+	ValidateToken func(r *http.Request, token string) error
+	// Close status code sent when token is missing, rejected or auth envelope is malformed.
+	// Defaults to ClosePolicyViolation.
+	AuthFailureCloseCode int
+	// Deliver messages of multiplexed streams to backend in order of sequence numbers.
+	// Messages are encoded as EncodeStream(id, EncodeSequence(seq, m)) with sequence starting at zero
+	// and restarting once stream is closed.
+	// Up to ReorderWindow messages ahead of next expected one are buffered per stream,
+	// messages further ahead and duplicates are dropped.
+	// Requires Multiplex. Ignored if zero.
+	ReorderWindow int
+	// Let client propose IdleTimeout and MaxSessionDuration of connection
+	// through IdleTimeoutHeader and SessionTimeoutHeader handshake headers.
+	// Upgrade is refused with 400 Bad Request if proposed timeout is out of bounds.
+	AllowClientTimeouts bool
+	// Bounds of timeouts proposed by client. If MaxClientTimeout is zero
+	// proposed timeout must not exceed configured IdleTimeout or MaxSessionDuration respectively.
+	MinClientTimeout time.Duration
+	MaxClientTimeout time.Duration
+	// Echo messages back to client instead of dispatching handler, useful for health probes.
+	// Messages are framed as if handler copied request body to response.
+	EchoMode bool
+	// Handling of messages from client sent in frame type other than expected.
+	// Binary frames are expected with LengthPrefixed or Multiplex and text frames otherwise.
+	// Mismatched messages are forwarded by default. Not supported with Reliable.
+	OnFrameTypeMismatch FrameTypePolicy
+	// Close websocket with FirstByteTimeoutCloseCode if backend produced no output within duration after dispatch.
+	// Ignored if zero or with Multiplex.
+	FirstByteTimeout time.Duration
+	// Close status code sent on FirstByteTimeout, defaults to CloseInternalServerErr.
+	FirstByteTimeoutCloseCode int
+	// Send Set-Cookie headers of backend response as message of form {"set_cookie": [cookies]}
+	// before response body. Cookies are discarded otherwise.
+	// Cookies become visible to client code, HttpOnly attribute is not enforced.
+	ForwardSetCookie bool
+	// Invoked with backend request right before it is dispatched to handler.
+	// Request may be modified, e.g. to add headers.
+	OnRequest func(*http.Request)
+	// Close websocket with FirstFrameTimeoutCloseCode if client sent no message within duration.
+	// With ReadToken, duration is measured after token was read. Ignored if zero.
+	FirstFrameTimeout time.Duration
+	// Close status code sent on FirstFrameTimeout, defaults to ClosePolicyViolation.
+	FirstFrameTimeoutCloseCode int
+	// Maximum total size of messages in bytes buffered by connection in both directions,
+	// i.e. pause buffer, resend buffer and reorder windows of streams.
+	// Websocket is closed with CloseMessageTooBig if exceeded. Ignored if zero.
+	MaxSessionBufferBytes int
+	// Send unsolicited pong frame every interval to keep NAT mappings and intermediaries alive,
+	// see RFC 6455 section 5.5.3. Clients are not expected to respond. Ignored if zero.
+	UnsolicitedPongInterval time.Duration
+	// Handling of invalid messages, websocket is closed on first invalid message by default.
+	// Only errors confined to single message are recoverable:
+	// message with length prefix not matching its length with LengthPrefixed,
+	// message missing stream ID or sequence number with Multiplex, ReorderWindow or Reliable,
+	// message sent to closed stream with Multiplex
+	// and response record that is not valid JSON with JSONAwareFraming or FirstLineIsMetadata.
+	// Transport errors, oversized messages and exceeded limits always close websocket.
+	ErrorPolicy ErrorPolicy
+	// Methods backend requests may be dispatched with, defaults to GET and POST.
+	// RewriteMethod outside of the list is rejected by NewWithError.
+	// Other methods, e.g. selected by RewriteMethodFor, close websocket with ClosePolicyViolation
+	// or refuse deferred upgrade with 405 Method Not Allowed.
+	AllowedMethods []string
+	// Flush request body after every message, for backends reading each message as discrete chunk.
+	// Otherwise messages received back to back are batched, flushing them once no further message
+	// is buffered or buffer filled up. Multiplexed streams are flushed after every message.
+	FlushEachInboundFrame bool
+	// Reject upgrade with 400 Bad Request unless client offers subprotocol.
+	// Required subprotocol is selected on successful handshake, taking precedence over UpgradeResponseHeaders.
+	// Not supported with TokenFromSubprotocol.
+	RequiredSubprotocol string
+	// Message sent before websocket is closed by Shutdown, telling client to reconnect.
+	// Sent before session summary. Not sent with Multiplex. Ignored if empty.
+	ReconnectMessage string
+	// Send up to n consecutive response records in single message.
+	// Records keep their framing, i.e. delimiter or length prefix, and are sent once batch is full.
+	// Not supported with JSONAwareFraming, FlushInterval or Multiplex. Ignored if zero.
+	CoalesceRecords int
+	// Send incomplete batch of CoalesceRecords once interval elapsed since its first record.
+	// Otherwise batch is sent only once full or response ends. Ignored if zero.
+	CoalesceFlushInterval time.Duration
+	// Dispatch backend requests through transport to URL selected by TargetURL
+	// instead of invoking handler passed to New. HandlerFor is ignored.
+	// Request body is streamed while response is read, HTTP/1.1 backends
+	// must respond before request body ends. Not supported with EchoMode.
+	Transport http.RoundTripper
+	// Select URL of backend requests dispatched through Transport, required if Transport is set.
+	// Request is rejected with 502 Bad Gateway if error is returned.
+	TargetURL func(*http.Request) (*url.URL, error)
+	// Reuse backend connection once request dispatched through Transport ends.
+	// Otherwise backend request is sent with "Connection: close" closing connection once it ends.
+	BackendKeepAlive bool
+	// Maximum number of backend requests handled concurrently across all connections.
+	// Beyond limit websocket is closed with CloseTryAgainLater, deferred upgrade is refused
+	// with 503 Service Unavailable and multiplexed streams are not opened. Ignored if zero.
+	MaxConcurrentHandlers int
+	// Handler responding to requests no handler was selected for, both passthrough and upgrade.
+	// Defaults to http.NotFound.
+	NotFoundHandler http.Handler
+	// Inspect websocket upgrade request after built-in checks including origin passed.
+	// Headers set on w are included in upgrade response.
+	// Upgrade is refused if error is returned, with status and body of UpgradeError
+	// or 403 Forbidden otherwise. Upgrade is refused with 500 Internal Server Error on panic.
+	// Not invoked by ServeWS.
+	BeforeUpgrade func(w http.ResponseWriter, r *http.Request) error
+	// Decompress response before framing if backend declares Content-Encoding gzip.
+	DecompressBackend bool
+	// Split response into records, each sent as single message, such as bufio.ScanWords.
+	// Defaults to records delimited by RecordDelimiter, request records are still delimited by it.
+	// Records must not exceed bufio.MaxScanTokenSize.
+	// Not supported with LengthPrefixed, JSONAwareFraming or FlushInterval.
+	SplitFunc bufio.SplitFunc
+	// Close websocket with CloseInvalidFramePayloadData if text message is not valid UTF-8,
+	// see RFC 6455 section 8.1. Applies regardless of ErrorPolicy.
+	ValidateUTF8 bool
+	// Send first response record, a JSON value describing the stream, as message of form
+	// {"metadata": record} instead of forwarding it. Invalid JSON is handled according to ErrorPolicy.
+	// Not supported with CoalesceRecords or Multiplex.
+	FirstLineIsMetadata bool
 }
 
+// BackendDonePolicy defines handling of websocket after backend handler finished
+type BackendDonePolicy int
+
+const (
+	// CloseAfterBackendDone closes websocket once response is forwarded.
+	CloseAfterBackendDone BackendDonePolicy = iota
+	// DiscardAfterBackendDone keeps websocket open until client closes it.
+	// Messages received after backend stopped reading request are discarded.
+	DiscardAfterBackendDone
+)
+
+// RedirectPolicy defines handling of redirect responses from backend
+type RedirectPolicy int
+
+const (
+	// IgnoreRedirects forwards response body ignoring redirect.
+	IgnoreRedirects RedirectPolicy = iota
+	// CloseOnRedirect closes websocket with CloseRedirect status code.
+	CloseOnRedirect
+	// NotifyRedirect sends message of form {"redirect": location} and closes websocket.
+	NotifyRedirect
+)
+
+// FrameTypePolicy defines handling of messages sent in unexpected frame type.
+type FrameTypePolicy int
+
+const (
+	// ConvertMismatchedFrames forwards payload regardless of frame type.
+	ConvertMismatchedFrames FrameTypePolicy = iota
+	// DropMismatchedFrames discards messages sent in unexpected frame type.
+	DropMismatchedFrames
+	// CloseOnMismatchedFrame closes websocket with CloseUnsupportedData.
+	CloseOnMismatchedFrame
+)
+
+// ErrorPolicy defines handling of invalid messages, see Config.ErrorPolicy.
+type ErrorPolicy int
+
+const (
+	// CloseOnInvalidMessage closes websocket on first invalid message.
+	CloseOnInvalidMessage ErrorPolicy = iota
+	// SkipInvalidMessages logs and discards invalid messages.
+	SkipInvalidMessages
+)
+
 // New creates instance of WebSocketProxy wrapping given http.Handler
 // Wrapped handler will proxy underlying request through websocket.
 // If upgrade to websocket is not requested handler will be invoked directly.
+// Panics if configuration is invalid, see NewWithError.
 func New(c Config, h http.Handler) *WebSocketProxy {
-	return &WebSocketProxy{c, h}
+	wp, err := NewWithError(c, h)
+	if err != nil {
+		panic(err)
+	}
+	return wp
+}
+
+// NewWithError creates instance of WebSocketProxy same as New.
+// Returns error if configuration is invalid.
+func NewWithError(c Config, h http.Handler) (*WebSocketProxy, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	wp := &WebSocketProxy{c: c, h: h, resumable: newResumeRegistry(), active: make(map[*session]struct{}), perIP: make(map[string]int)}
+	if c.MaxConcurrentHandlers > 0 {
+		wp.handlers = make(chan struct{}, c.MaxConcurrentHandlers)
+	}
+	return wp, nil
+}
+
+// notFound returns handler responding to requests without selected handler.
+func (c *Config) notFound() http.Handler {
+	if c.NotFoundHandler != nil {
+		return c.NotFoundHandler
+	}
+	return http.NotFoundHandler()
+}
+
+var defaultAllowedMethods = []string{http.MethodGet, http.MethodPost}
+
+// methodAllowed reports whether backend request may be dispatched with method m.
+func (c *Config) methodAllowed(m string) bool {
+	allowed := c.AllowedMethods
+	if len(allowed) == 0 {
+		allowed = defaultAllowedMethods
+	}
+	for _, a := range allowed {
+		if a == m {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) recordDelimiter() string {
+	if c.RecordDelimiter != "" {
+		return c.RecordDelimiter
+	}
+	return "\n"
+}
+
+func (c *Config) jsonCodec() JSONCodec {
+	if c.JSONCodec != nil {
+		return c.JSONCodec
+	}
+	return StdJSONCodec{}
+}
+
+func (c *Config) limitCloseCode() int {
+	if c.MaxMessagesCloseCode != 0 {
+		return c.MaxMessagesCloseCode
+	}
+	return ClosePolicyViolation
+}
+
+func (c *Config) firstByteCloseCode() int {
+	if c.FirstByteTimeoutCloseCode != 0 {
+		return c.FirstByteTimeoutCloseCode
+	}
+	return CloseInternalServerErr
+}
+
+func (c *Config) firstFrameCloseCode() int {
+	if c.FirstFrameTimeoutCloseCode != 0 {
+		return c.FirstFrameTimeoutCloseCode
+	}
+	return ClosePolicyViolation
+}
+
+func (c *Config) authCloseCode() int {
+	if c.AuthFailureCloseCode != 0 {
+		return c.AuthFailureCloseCode
+	}
+	return ClosePolicyViolation
+}
+
+func (c *Config) validate() error {
+	if c.RewriteMethod != "" {
+		if _, err := http.NewRequest(c.RewriteMethod, "/", nil); err != nil {
+			return fmt.Errorf("shaxbee/go-wsproxy: invalid RewriteMethod: %w", err)
+		}
+		if !c.methodAllowed(c.RewriteMethod) {
+			return fmt.Errorf("shaxbee/go-wsproxy: RewriteMethod %s is not in AllowedMethods", c.RewriteMethod)
+		}
+	}
+	if c.Reliable && (c.LengthPrefixed || c.Multiplex) {
+		return errors.New("shaxbee/go-wsproxy: Reliable is not supported with LengthPrefixed or Multiplex")
+	}
+	if c.EnableSSEFallback && c.LengthPrefixed {
+		return errors.New("shaxbee/go-wsproxy: EnableSSEFallback is not supported with LengthPrefixed")
+	}
+	if c.DeferUpgradeUntilBackendResponds && c.Multiplex {
+		return errors.New("shaxbee/go-wsproxy: Multiplex is not supported with DeferUpgradeUntilBackendResponds")
+	}
+	if c.DeferUpgradeUntilBackendResponds && c.ReadToken {
+		return errors.New("shaxbee/go-wsproxy: ReadToken is not supported with DeferUpgradeUntilBackendResponds")
+	}
+	if c.JSONAwareFraming && c.LengthPrefixed {
+		return errors.New("shaxbee/go-wsproxy: JSONAwareFraming is not supported with LengthPrefixed")
+	}
+	if c.FlushInterval > 0 && (c.LengthPrefixed || c.JSONAwareFraming || c.Multiplex) {
+		return errors.New("shaxbee/go-wsproxy: FlushInterval is not supported with LengthPrefixed, JSONAwareFraming or Multiplex")
+	}
+	if c.RequiredSubprotocol != "" && c.TokenFromSubprotocol {
+		return errors.New("shaxbee/go-wsproxy: RequiredSubprotocol is not supported with TokenFromSubprotocol")
+	}
+	if c.Transport != nil && c.TargetURL == nil {
+		return errors.New("shaxbee/go-wsproxy: Transport requires TargetURL")
+	}
+	if c.Transport != nil && c.EchoMode {
+		return errors.New("shaxbee/go-wsproxy: Transport is not supported with EchoMode")
+	}
+	if c.CoalesceRecords > 0 && (c.JSONAwareFraming || c.FlushInterval > 0 || c.Multiplex) {
+		return errors.New("shaxbee/go-wsproxy: CoalesceRecords is not supported with JSONAwareFraming, FlushInterval or Multiplex")
+	}
+	if c.FirstLineIsMetadata && (c.CoalesceRecords > 0 || c.Multiplex) {
+		return errors.New("shaxbee/go-wsproxy: FirstLineIsMetadata is not supported with CoalesceRecords or Multiplex")
+	}
+	if c.SplitFunc != nil && (c.LengthPrefixed || c.JSONAwareFraming || c.FlushInterval > 0) {
+		return errors.New("shaxbee/go-wsproxy: SplitFunc is not supported with LengthPrefixed, JSONAwareFraming or FlushInterval")
+	}
+	if c.FrameTypeFromContentType && (c.LengthPrefixed || c.Multiplex || c.Reliable) {
+		return errors.New("shaxbee/go-wsproxy: FrameTypeFromContentType is not supported with LengthPrefixed, Multiplex or Reliable")
+	}
+	if c.MaxFramesInFlight > 0 && c.Multiplex {
+		return errors.New("shaxbee/go-wsproxy: MaxFramesInFlight is not supported with Multiplex")
+	}
+	if c.ReorderWindow > 0 && !c.Multiplex {
+		return errors.New("shaxbee/go-wsproxy: ReorderWindow requires Multiplex")
+	}
+	if c.OnFrameTypeMismatch != ConvertMismatchedFrames && c.Reliable {
+		return errors.New("shaxbee/go-wsproxy: OnFrameTypeMismatch is not supported with Reliable")
+	}
+	if c.SimulatedDropRate < 0 || c.SimulatedDropRate > 1 {
+		return errors.New("shaxbee/go-wsproxy: SimulatedDropRate must be in range [0, 1]")
+	}
+	return nil
 }
 
 func (wp *WebSocketProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if strings.ToLower(r.Header.Get("Upgrade")) != "websocket" {
-		wp.h.ServeHTTP(w, r)
+	h, err := wp.handler(r)
+	if err != nil {
+		logger.Errorf("shaxbee/go-wsproxy: Error selecting target URL: %s", err)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	} else if h == nil {
+		wp.c.notFound().ServeHTTP(w, r)
 		return
 	}
 
-	wsh := websocket.Handler(func(ws *websocket.Conn) { wp.proxy(r, ws) })
-	wsh.ServeHTTP(w, r)
-}
+	up := strings.ToLower(r.Header.Get("Upgrade"))
+	if up != "" && up != "websocket" && !wp.c.PassthroughUpgrades {
+		http.Error(w, "Unsupported upgrade", http.StatusNotImplemented)
+		return
+	}
 
-func (wp *WebSocketProxy) proxy(req *http.Request, ws *websocket.Conn) {
-	defer ws.Close()
+	if up != "websocket" {
+		wp.disposition(r, false)
+		if wp.c.EnableSSEFallback && acceptsSSE(r) {
+			serveSSE(h, w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+		return
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	if wp.isClosing() {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if atomic.LoadInt32(&wp.refusing) != 0 {
+		http.Error(w, "Not accepting websocket connections", http.StatusServiceUnavailable)
+		return
+	}
 
-	orp, iwp := io.Pipe()
-	defer iwp.Close()
+	if wp.c.MaxConnectionsPerIP > 0 {
+		ip := clientIP(r)
+		if !wp.acquireIP(ip) {
+			http.Error(w, "Too many connections", http.StatusTooManyRequests)
+			return
+		}
+		defer wp.releaseIP(ip)
+	}
 
-	irp, owp := io.Pipe()
-	defer owp.Close()
+	if wp.c.MaxHandshakeHeaderBytes > 0 && headerSize(r.Header) > wp.c.MaxHandshakeHeaderBytes {
+		http.Error(w, "Request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
 
-	var method string
-	if wp.c.RewriteMethod != "" {
-		method = wp.c.RewriteMethod
+	if wp.c.AllowClientTimeouts {
+		if err := wp.c.checkClientTimeouts(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if wp.c.RequiredSubprotocol != "" && !offersProtocol(r, wp.c.RequiredSubprotocol) {
+		http.Error(w, "Required subprotocol not offered", http.StatusBadRequest)
+		return
+	}
+
+	if wp.c.RequireVersion13 && r.Header.Get("Sec-WebSocket-Version") != websocket.SupportedProtocolVersion {
+		w.Header().Set("Sec-WebSocket-Version", websocket.SupportedProtocolVersion)
+		http.Error(w, "Unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	// Checked ahead of handshake as both BeforeUpgrade and deferred upgrade act on request.
+	if _, err := wp.origin(r); err != nil {
+		logger.Debugf("shaxbee/go-wsproxy: Upgrade refused: %s", err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if wp.c.BeforeUpgrade != nil && !wp.beforeUpgrade(w, r) {
+		return
+	}
+
+	hw := &hijackWriter{ResponseWriter: w, timeout: wp.c.HandshakeTimeout}
+	if wp.c.DeferUpgradeUntilBackendResponds {
+		wp.upgradeDeferred(h, hw, r)
+		return
+	}
+
+	wss := websocket.Server{
+		Handshake: wp.upgradeHandshake(hw),
+		Handler:   func(ws *websocket.Conn) { wp.proxy(h, r, ws, hw.conn, hw.inbound, nil) },
+	}
+	wss.ServeHTTP(hw, r)
+}
+
+// beforeUpgrade invokes Config.BeforeUpgrade, responding to r if upgrade was refused.
+// Returns false if upgrade was refused.
+func (wp *WebSocketProxy) beforeUpgrade(w http.ResponseWriter, r *http.Request) bool {
+	var err error
+	if !wp.c.hook(nil, "BeforeUpgrade", func() { err = wp.c.BeforeUpgrade(w, r) }) {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if err == nil {
+		return true
+	}
+
+	logger.Debugf("shaxbee/go-wsproxy: Upgrade refused: %s", err)
+	var ue *UpgradeError
+	if errors.As(err, &ue) {
+		http.Error(w, ue.Body, ue.Status)
 	} else {
-		method = req.Method
+		http.Error(w, "Forbidden", http.StatusForbidden)
 	}
+	return false
+}
 
-	nreq, err := http.NewRequest(method, req.URL.String(), irp)
+// disposition reports whether request is upgraded if Config.OnDisposition is set.
+func (wp *WebSocketProxy) disposition(r *http.Request, upgraded bool) {
+	if wp.c.OnDisposition != nil {
+		wp.c.hook(nil, "OnDisposition", func() { wp.c.OnDisposition(r, upgraded) })
+	}
+}
+
+// headerSize returns size of h written as "Key: value\r\n" lines.
+func headerSize(h http.Header) int {
+	n := 0
+	for k, vs := range h {
+		for _, v := range vs {
+			n += len(k) + len(v) + len(": \r\n")
+		}
+	}
+	return n
+}
+
+// upgradeDeferred dispatches backend before upgrade.
+// Backend response is returned instead of upgrade unless backend responds with 2xx status.
+func (wp *WebSocketProxy) upgradeDeferred(h http.Handler, hw *hijackWriter, r *http.Request) {
+	rctx, end := wp.startSpan(r)
+	cred, ok := wp.credentials(nil, r)
+	if !ok {
+		http.Error(hw, "Unauthorized", http.StatusUnauthorized)
+		if end != nil {
+			end(Stats{CloseReason: closeReasonUnauthorized}, ErrTokenRejected)
+		}
+		return
+	}
+	rf := &responseForwarder{h: make(http.Header), status: make(chan int, 1), decided: make(chan struct{})}
+	b, err := wp.dispatch(h, r, rctx, cred, rf)
 	if err != nil {
-		glog.Errorf("shaxbee/go-wsproxy: Error creating request: %s", err)
+		logger.Errorf("shaxbee/go-wsproxy: Error creating request: %s", err)
+		if errors.Is(err, ErrMethodNotAllowed) {
+			http.Error(hw, "Method not allowed", http.StatusMethodNotAllowed)
+		} else if err == ErrTooManyHandlers {
+			http.Error(hw, "Too many concurrent requests", http.StatusServiceUnavailable)
+		} else {
+			http.Error(hw, "Internal server error", http.StatusInternalServerError)
+		}
+		if end != nil {
+			end(Stats{CloseReason: closeReasonError}, err)
+		}
+		return
 	}
-	if wp.c.ReadToken {
-		var tok string
-		if err := websocket.Message.Receive(ws, &tok); err != nil {
-			return
+	b.end = end
+
+	code := http.StatusOK
+	select {
+	case code = <-rf.status:
+	case <-b.done:
+	}
+
+	if code < 200 || code >= 300 {
+		logger.Debugf("shaxbee/go-wsproxy: Backend rejected websocket upgrade with status %d", code)
+		for k, v := range rf.h {
+			hw.Header()[k] = v
+		}
+		hw.WriteHeader(code)
+		b.reject(hw)
+		<-b.done
+		if end != nil {
+			end(Stats{CloseReason: closeReasonRejected, RequestID: b.requestID}, nil)
 		}
-		nreq.Header.Set("Authorization", "Bearer "+tok)
+		return
 	}
-	nreq.Cancel = ctx.Done()
 
-	glog.V(2).Infof("shaxbee/go-wsproxy: Forwarding websocket to %s %s", method, req.URL.String())
-	go wp.h.ServeHTTP(respForwarder(iwp), nreq)
+	wss := websocket.Server{
+		Handshake: wp.upgradeHandshake(hw),
+		Handler:   func(ws *websocket.Conn) { wp.proxy(h, r, ws, hw.conn, hw.inbound, b) },
+	}
+	wss.ServeHTTP(hw, r)
 
-	go listenWrite(ctx, ws, bufio.NewReader(orp))
-	listenRead(ctx, ws, bufio.NewWriter(owp))
+	if !b.accepted {
+		// Handler streaming response is only stopped by cancellation.
+		b.reject(ioutil.Discard)
+		b.close()
+		<-b.done
+		if end != nil {
+			end(Stats{CloseReason: closeReasonError, RequestID: b.requestID}, ErrUpgradeFailed)
+		}
+	}
 }
 
-func listenRead(ctx context.Context, ws *websocket.Conn, w *bufio.Writer) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			var m string
-			err := websocket.Message.Receive(ws, &m)
-			if err == io.EOF {
-				return
-			} else if err != nil {
-				glog.Errorf("shaxbee/go-wsproxy: Error while reading from websocket: %s", err)
-				return
+// ServeWS proxies websocket already upgraded by r to handler.
+// Options applying to upgrade are ignored, ConfigureConn is invoked with ws.
+func (wp *WebSocketProxy) ServeWS(ws *websocket.Conn, r *http.Request) {
+	h, err := wp.handler(r)
+	if err != nil {
+		logger.Errorf("shaxbee/go-wsproxy: Error selecting target URL: %s", err)
+		ws.Close()
+		return
+	} else if h == nil {
+		logger.Debugf("shaxbee/go-wsproxy: No handler for %s", r.URL.Path)
+		ws.Close()
+		return
+	}
+	wp.proxy(h, r, ws, ws, nil, nil)
+}
+
+// upgradeHandshake returns websocket.Server handshake including headers set on hw by Config.BeforeUpgrade.
+func (wp *WebSocketProxy) upgradeHandshake(hw *hijackWriter) func(*websocket.Config, *http.Request) error {
+	var h http.Header
+	if wp.c.BeforeUpgrade != nil {
+		h = hw.Header()
+	}
+	return func(config *websocket.Config, r *http.Request) error {
+		return wp.handshake(config, r, h)
+	}
+}
+
+// handshake validates upgrade request and prepares upgrade response.
+// Headers h set by Config.BeforeUpgrade are included in response.
+func (wp *WebSocketProxy) handshake(config *websocket.Config, r *http.Request, h http.Header) (err error) {
+	config.Origin, err = wp.origin(r)
+	if err != nil {
+		return err
+	}
+
+	if len(wp.c.UpgradeResponseHeaders) > 0 || len(h) > 0 {
+		config.Header = make(http.Header, len(wp.c.UpgradeResponseHeaders)+len(h))
+		for k, v := range wp.c.UpgradeResponseHeaders {
+			config.Header[k] = v
+		}
+		for k, v := range h {
+			config.Header[k] = v
+		}
+		if p := config.Header.Get("Sec-WebSocket-Protocol"); p != "" {
+			config.Protocol = []string{p}
+		}
+	}
+
+	if wp.c.RequiredSubprotocol != "" {
+		config.Protocol = []string{wp.c.RequiredSubprotocol}
+	}
+
+	if wp.c.TokenFromSubprotocol {
+		if _, ok := subprotocolToken(config.Protocol); !ok {
+			return errors.New("missing bearer subprotocol")
+		}
+		config.Protocol = []string{bearerSubprotocol}
+	}
+
+	return nil
+}
+
+// origin returns origin of websocket request r.
+// Returns error if origin is missing, same as websocket.Handler, or not in Config.AllowedOrigins.
+func (wp *WebSocketProxy) origin(r *http.Request) (*url.URL, error) {
+	origin, err := websocket.Origin(&websocket.Config{Version: websocket.ProtocolVersionHybi13}, r)
+	if err == nil && origin == nil {
+		return nil, errors.New("null origin")
+	} else if err != nil {
+		return nil, err
+	}
+	if len(wp.c.AllowedOrigins) > 0 && !originAllowed(origin, wp.c.AllowedOrigins) {
+		return nil, fmt.Errorf("origin %s not allowed", origin)
+	}
+	return origin, nil
+}
+
+// originAllowed reports whether origin matches any of allowed origins.
+func originAllowed(origin *url.URL, allowed []string) bool {
+	for _, a := range allowed {
+		host := a
+		if i := strings.Index(a, "://"); i >= 0 {
+			if !strings.EqualFold(a[:i], origin.Scheme) {
+				continue
 			}
+			host = a[i+len("://"):]
+		}
+		// Entry without port matches any port.
+		if h, port, err := net.SplitHostPort(host); err == nil {
+			if port != origin.Port() {
+				continue
+			}
+			host = h
+		}
+		if strings.HasPrefix(host, "*.") {
+			// Wildcard matches whole labels only, "*.example.com" does not match "example.com".
+			suffix := strings.ToLower(host[1:])
+			hostname := strings.ToLower(origin.Hostname())
+			if len(hostname) > len(suffix) && strings.HasSuffix(hostname, suffix) {
+				return true
+			}
+		} else if strings.EqualFold(strings.Trim(host, "[]"), origin.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+const bearerSubprotocol = "bearer"
+
+// subprotocolToken returns token following "bearer" in offered subprotocols.
+func subprotocolToken(protocols []string) (string, bool) {
+	for i := 0; i < len(protocols)-1; i++ {
+		if protocols[i] == bearerSubprotocol {
+			return protocols[i+1], true
+		}
+	}
+	return "", false
+}
+
+// offeredProtocols returns subprotocols offered by client.
+func offeredProtocols(r *http.Request) []string {
+	var protocols []string
+	for _, p := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			protocols = append(protocols, p)
+		}
+	}
+	return protocols
+}
+
+// offersProtocol reports whether client offered subprotocol p.
+func offersProtocol(r *http.Request, p string) bool {
+	for _, o := range offeredProtocols(r) {
+		if o == p {
+			return true
+		}
+	}
+	return false
+}
+
+// withToken forwards token to backend request in Authorization header and context.
+// Request is left intact if token is empty.
+func withToken(r *http.Request, tok string) *http.Request {
+	if tok == "" {
+		return r
+	}
+	r.Header.Set("Authorization", "Bearer "+tok)
+	return r.WithContext(context.WithValue(r.Context(), TokenContextKey, tok))
+}
+
+// credentials are forwarded to backend request.
+type credentials struct {
+	token string
+	// headers mapped from auth envelope or describing session
+	header http.Header
+}
+
+func (c credentials) apply(r *http.Request) *http.Request {
+	for k, v := range c.header {
+		r.Header[k] = v
+	}
+	return withToken(r, c.token)
+}
+
+// authEnvelope maps string fields of JSON object to headers.
+func (wp *WebSocketProxy) authEnvelope(b []byte) (http.Header, error) {
+	var fields map[string]interface{}
+	if err := wp.c.jsonCodec().Unmarshal(b, &fields); err != nil {
+		return nil, wrapError(ErrBadAuthEnvelope, err)
+	}
+
+	h := make(http.Header, len(wp.c.AuthEnvelope))
+	for field, name := range wp.c.AuthEnvelope {
+		v, ok := fields[field]
+		if !ok {
+			continue
+		}
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: field %s is not a string", ErrBadAuthEnvelope, field)
+		}
+		h.Set(name, str)
+	}
+	return h, nil
+}
 
-			w.WriteString(m)
-			w.WriteRune('\n')
-			if err := w.Flush(); err != nil {
-				glog.Errorf("shaxbee/go-wsproxy: Error while writing request: %s", err)
-				return
+// credentials returns credentials forwarded to backend.
+// Returns false if session was closed while reading credentials.
+func (wp *WebSocketProxy) credentials(s *session, req *http.Request) (credentials, bool) {
+	tok, ok := wp.token(s, req)
+	if !ok {
+		return credentials{}, false
+	}
+
+	if wp.c.ValidateToken != nil && !wp.public(req) {
+		if err := wp.validateToken(req, tok); err != nil {
+			logger.Debugf("shaxbee/go-wsproxy: Token rejected: %s", err)
+			if s != nil {
+				s.closeWith(wp.c.authCloseCode(), closeReasonUnauthorized, err)
 			}
+			return credentials{}, false
+		}
+	}
+
+	cred := credentials{token: tok}
+	if len(wp.c.AuthEnvelope) > 0 && wp.c.ReadToken && !wp.public(req) {
+		h, err := wp.authEnvelope([]byte(tok))
+		if err != nil {
+			logger.Debugf("shaxbee/go-wsproxy: Invalid auth envelope: %s", err)
+			s.closeWith(wp.c.authCloseCode(), closeReasonUnauthorized, err)
+			return credentials{}, false
 		}
+		cred = credentials{header: h}
 	}
+
+	if wp.c.SubprotocolHeader != "" && s != nil {
+		if p := s.ws.Config().Protocol; len(p) == 1 {
+			if cred.header == nil {
+				cred.header = make(http.Header)
+			}
+			cred.header.Set(wp.c.SubprotocolHeader, p[0])
+		}
+	}
+	return cred, true
 }
 
-func listenWrite(ctx context.Context, ws *websocket.Conn, r *bufio.Reader) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			s, err := r.ReadString('\n')
-			if err == io.EOF {
-				return
-			} else if err != nil {
-				glog.Errorf("shaxbee/go-wsproxy: Error while reading response: %s", err)
-				return
+// validateToken checks token with Config.ValidateToken.
+// Panicking validator rejects token regardless of HookPanicPolicy.
+func (wp *WebSocketProxy) validateToken(req *http.Request, tok string) error {
+	var err error
+	if !wp.c.hook(nil, "ValidateToken", func() { err = wp.c.ValidateToken(req, tok) }) {
+		return ErrHookPanic
+	}
+	if err != nil {
+		return wrapError(ErrTokenRejected, err)
+	}
+	return nil
+}
+
+// token returns token forwarded to backend.
+// Returns false if session was closed while reading token.
+func (wp *WebSocketProxy) token(s *session, req *http.Request) (string, bool) {
+	if wp.c.ReadToken && !wp.public(req) {
+		_, b, err := receive(s.ws, new(bytes.Buffer), wp.c.MaxFragments)
+		if ce, ok := err.(*CloseError); ok {
+			s.closeReceived(ce)
+			return "", false
+		} else if err == io.EOF {
+			s.close(closeReasonClient, nil)
+			return "", false
+		} else if err != nil {
+			s.fail(err)
+			return "", false
+		}
+		if len(b) == 0 && wp.c.RequireToken {
+			s.closeWith(wp.c.authCloseCode(), closeReasonUnauthorized, ErrTokenMissing)
+			return "", false
+		}
+		return string(b), true
+	}
+	if wp.c.TokenFromSubprotocol {
+		tok, _ := subprotocolToken(offeredProtocols(req))
+		return tok, true
+	}
+	return "", true
+}
+
+// requestID returns request ID of websocket request or generates new one.
+// Returns empty string if RequestIDHeader is not set.
+func (wp *WebSocketProxy) requestID(req *http.Request) string {
+	if wp.c.RequestIDHeader == "" {
+		return ""
+	}
+	if id := req.Header.Get(wp.c.RequestIDHeader); id != "" {
+		return id
+	}
+	if wp.c.GenerateRequestID != nil {
+		var id string
+		if wp.c.hook(nil, "GenerateRequestID", func() { id = wp.c.GenerateRequestID() }) {
+			return id
+		}
+	}
+	return randomID()
+}
+
+func randomID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		logger.Errorf("shaxbee/go-wsproxy: Error generating request ID: %s", err)
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// public reports whether request path is listed in PublicPaths.
+func (wp *WebSocketProxy) public(req *http.Request) bool {
+	for _, p := range wp.c.PublicPaths {
+		if req.URL.Path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// startSpan starts tracing span if configured.
+// Returned function is nil if StartSpan is not set.
+func (wp *WebSocketProxy) startSpan(req *http.Request) (context.Context, func(Stats, error)) {
+	if wp.c.StartSpan == nil {
+		return context.Background(), nil
+	}
+
+	var (
+		ctx = context.Background()
+		end func(Stats, error)
+	)
+	wp.c.hook(nil, "StartSpan", func() { ctx, end = wp.c.StartSpan(req.Context(), req) })
+	if end == nil {
+		return ctx, nil
+	}
+	return ctx, func(st Stats, err error) {
+		wp.c.hook(nil, "StartSpan", func() { end(st, err) })
+	}
+}
+
+func (wp *WebSocketProxy) handler(r *http.Request) (http.Handler, error) {
+	if wp.c.EchoMode {
+		return echoHandler, nil
+	}
+	if wp.c.Transport != nil {
+		return wp.remote(r)
+	}
+	if wp.c.HandlerFor != nil {
+		var h http.Handler
+		if wp.c.hook(nil, "HandlerFor", func() { h = wp.c.HandlerFor(r) }) {
+			return h, nil
+		}
+	}
+	return wp.h, nil
+}
+
+// echoHandler writes request body back to response, see Config.EchoMode.
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.Copy(w, r.Body)
+})
+
+// method returns method of backend request.
+func (wp *WebSocketProxy) method(r *http.Request) string {
+	if wp.c.RewriteMethodFor != nil {
+		var m string
+		if wp.c.hook(nil, "RewriteMethodFor", func() { m = wp.c.RewriteMethodFor(r) }) {
+			if m != "" {
+				return m
 			}
+			return r.Method
+		}
+	}
+	if wp.c.RewriteMethod != "" {
+		return wp.c.RewriteMethod
+	}
+	return r.Method
+}
+
+func (wp *WebSocketProxy) proxy(h http.Handler, req *http.Request, ws *websocket.Conn, conn net.Conn, inbound *bufio.Reader, b *backend) {
+	defer ws.Close()
+	wp.disposition(req, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newSession(&wp.c, req, ws, conn, cancel)
+	s.inbound = inbound
+	defer func() { s.metric(MetricWriteBlocked, s.snapshot().WriteBlocked.Seconds(), nil) }()
+	if wp.c.OnDisconnect != nil {
+		defer func() {
+			wp.c.hook(nil, "OnDisconnect", func() { wp.c.OnDisconnect(req, s.snapshot(), s.error()) })
+		}()
+	}
+	tracked := wp.track(s)
+	if tracked {
+		defer wp.untrack(s)
+	}
+	defer s.closeConn()
+	if !tracked {
+		s.closeWith(CloseGoingAway, closeReasonShutdown, nil)
+		return
+	}
 
-			if err := websocket.Message.Send(ws, s); err != nil {
-				glog.Errorf("shaxbee/go-wsproxy: Error while writing to websocket: %s", err)
-				return
+	if wp.c.Reliable {
+		s.reliable = wp.resendBuffer(req)
+		defer wp.park(s.reliable)
+	}
+
+	if wp.c.HandshakeTimeout > 0 {
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			s.log.Errorf("shaxbee/go-wsproxy: Error clearing handshake deadline: %s", err)
+			s.fail(wrapError(ErrUpgradeFailed, err))
+			return
+		}
+	}
+
+	if wp.c.ConfigureConn != nil {
+		var err error
+		wp.c.hook(s, "ConfigureConn", func() { err = wp.c.ConfigureConn(conn) })
+		if err != nil {
+			s.log.Errorf("shaxbee/go-wsproxy: Error configuring connection: %s", err)
+			s.fail(wrapError(ErrUpgradeFailed, err))
+			return
+		}
+	}
+
+	// Base context of backend request.
+	var (
+		rctx context.Context
+		end  func(Stats, error)
+	)
+	if b != nil {
+		// Backend already dispatched and accepted upgrade.
+		b.accept(s)
+		end = b.end
+	} else {
+		rctx, end = wp.startSpan(req)
+	}
+	if end != nil {
+		defer func() { end(s.snapshot(), s.error()) }()
+	}
+
+	if b == nil {
+		cred, ok := wp.credentials(s, req)
+		if !ok {
+			return
+		}
+
+		if wp.c.Multiplex {
+			s.startTimers()
+			defer s.stopTimers()
+
+			wp.multiplex(ctx, s, h, req, rctx, cred)
+			return
+		}
+
+		var err error
+		b, err = wp.dispatch(h, req, rctx, cred, &responseForwarder{h: make(http.Header), s: s})
+		if err != nil {
+			s.log.Errorf("shaxbee/go-wsproxy: Error creating request: %s", err)
+			if errors.Is(err, ErrMethodNotAllowed) {
+				s.closeWith(ClosePolicyViolation, closeReasonError, err)
+			} else if err == ErrTooManyHandlers {
+				s.closeWith(CloseTryAgainLater, closeReasonHandlerLimit, err)
+			} else {
+				s.close(closeReasonError, err)
 			}
+			return
 		}
 	}
+	defer b.close()
+	s.setRequestID(b.requestID)
+	s.watchOutput()
+
+	if err := s.resume(); err == ErrSessionBufferFull {
+		s.overflow()
+		return
+	} else if err != nil {
+		s.log.Debugf("shaxbee/go-wsproxy: Error while resending messages: %s", err)
+		s.fail(err)
+		return
+	}
+
+	s.startTimers()
+	defer s.stopTimers()
+
+	readDone := make(chan struct{})
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		s.listenWrite(ctx, bufio.NewReader(b.body()))
+	}()
+	go func() {
+		defer close(readDone)
+		s.listenRead(ctx, bufio.NewWriter(b.owp))
+	}()
+
+	// Tear down in fixed order once either side terminated session:
+	// backend request and pipes first, websocket last.
+	<-ctx.Done()
+	s.closing()
+	b.close()
+	<-writeDone
+
+	if !s.isFailed() {
+		s.sendRedirect()
+		s.sendBackendError()
+		s.sendReconnect()
+		if wp.c.SendSessionSummary {
+			s.sendSummary()
+		}
+	}
+
+	// Close acknowledgement or remaining messages are read by closeConn once listenRead returned.
+	s.interrupt()
+	<-readDone
+	s.closeConn()
+	<-b.done
+}
+
+// backend is a handler dispatched with request and response body streamed through pipes.
+type backend struct {
+	orp *io.PipeReader // response body
+	owp *io.PipeWriter // request body
+	rf  *responseForwarder
+	// propagated to backend request
+	requestID string
+	// cancels backend request
+	cancel context.CancelFunc
+	// closed once handler returns
+	done chan struct{}
+	// ends tracing span of deferred upgrade
+	end func(Stats, error)
+	// set once session took over deferred upgrade
+	accepted bool
+	// guards close
+	closeOnce sync.Once
+}
+
+// dispatch starts handler in background forwarding response to rf.
+func (wp *WebSocketProxy) dispatch(h http.Handler, req *http.Request, ctx context.Context, cred credentials, rf *responseForwarder) (*backend, error) {
+	method := wp.method(req)
+	if !wp.c.methodAllowed(method) {
+		return nil, wrapError(ErrMethodNotAllowed, fmt.Errorf("method %q", method))
+	}
+	if !wp.acquireHandler() {
+		return nil, ErrTooManyHandlers
+	}
+
+	orp, iwp := io.Pipe()
+	irp, owp := io.Pipe()
+
+	// Handler observes session teardown through request context.
+	cctx, cancel := context.WithCancel(ctx)
+	nreq, err := http.NewRequestWithContext(cctx, method, req.URL.String(), irp)
+	if err != nil {
+		cancel()
+		wp.releaseHandler()
+		return nil, wrapError(ErrBackendFailed, err)
+	}
+	nreq = cred.apply(nreq)
+	if wp.c.RequestContentType != "" {
+		nreq.Header.Set("Content-Type", wp.c.RequestContentType)
+	}
+	if wp.c.ForwardOriginalPath {
+		nreq.Header.Set("X-Original-URI", req.URL.RequestURI())
+	}
+
+	id := wp.requestID(req)
+	if id != "" {
+		nreq.Header.Set(wp.c.RequestIDHeader, id)
+	}
+
+	if wp.c.OnRequest != nil {
+		wp.c.hook(nil, "OnRequest", func() { wp.c.OnRequest(nreq) })
+	}
 
+	rf.PipeWriter = iwp
+	b := &backend{orp: orp, owp: owp, rf: rf, requestID: id, cancel: cancel, done: make(chan struct{})}
+
+	logger.Debugf("shaxbee/go-wsproxy: Forwarding websocket to %s %s", method, req.URL.String())
+	go func() {
+		defer close(b.done)
+		defer wp.releaseHandler()
+		// Signal end of response and stop accepting request once handler finished.
+		defer iwp.Close()
+		defer irp.Close()
+
+		h.ServeHTTP(rf, nreq)
+	}()
+
+	return b, nil
+}
+
+// acquireHandler reserves slot of Config.MaxConcurrentHandlers.
+// Returns false if all slots are taken.
+func (wp *WebSocketProxy) acquireHandler() bool {
+	if wp.handlers == nil {
+		return true
+	}
+	select {
+	case wp.handlers <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (wp *WebSocketProxy) releaseHandler() {
+	if wp.handlers != nil {
+		<-wp.handlers
+	}
+}
+
+// accept forwards response of deferred upgrade to session.
+func (b *backend) accept(s *session) {
+	b.accepted = true
+	b.rf.s = s
+	close(b.rf.decided)
+}
+
+// close cancels backend request and closes pipes unblocking both handler and session.
+// Request body is closed before response, subsequent calls are no-op.
+func (b *backend) close() {
+	b.closeOnce.Do(func() {
+		b.cancel()
+		b.owp.Close()
+		b.orp.Close()
+	})
+}
+
+// body returns response body, decompressed if Config.DecompressBackend is set.
+func (b *backend) body() io.Reader {
+	if b.rf.s.c.DecompressBackend {
+		return newDecompressor(b.orp, b.rf)
+	}
+	return b.orp
 }
 
-func respForwarder(w *io.PipeWriter) http.ResponseWriter {
-	return &responseForwarder{w, make(http.Header)}
+// reject forwards response of deferred upgrade to w and terminates request body.
+func (b *backend) reject(w io.Writer) {
+	b.rf.rejected = w
+	close(b.rf.decided)
+	b.owp.Close()
 }
 
 type responseForwarder struct {
 	*io.PipeWriter
-	h http.Header
+	h           http.Header
+	s           *session
+	wroteHeader bool
+	wroteOutput bool
+	discard     bool
+	// set if response is gzip encoded and Config.DecompressBackend is set
+	gzip bool
+
+	// Set if upgrade is deferred until backend responds.
+	status  chan int
+	decided chan struct{}
+	// Destination of response if upgrade was rejected.
+	rejected io.Writer
+}
+
+func (rf *responseForwarder) Write(b []byte) (int, error) {
+	if !rf.wroteHeader {
+		rf.WriteHeader(http.StatusOK)
+	}
+	if rf.rejected != nil {
+		return rf.rejected.Write(b)
+	}
+	if !rf.wroteOutput {
+		rf.wroteOutput = true
+		rf.s.wroteOutput()
+	}
+	if rf.discard {
+		return len(b), nil
+	}
+	return rf.PipeWriter.Write(b)
 }
 
 func (rf *responseForwarder) Header() http.Header {
 	return rf.h
 }
 
-func (rf *responseForwarder) WriteHeader(int) {
-
+func (rf *responseForwarder) WriteHeader(code int) {
+	if rf.wroteHeader {
+		return
+	}
+	rf.wroteHeader = true
+	if rf.status != nil {
+		// Wait until upgrade is accepted or rejected.
+		rf.status <- code
+		<-rf.decided
+		if rf.rejected != nil {
+			return
+		}
+	}
+	rf.gzip = rf.s.c.DecompressBackend && strings.EqualFold(rf.h.Get("Content-Encoding"), "gzip")
+	rf.discard = rf.s.writeHeader(code, rf.h)
 }
 
 func (rf *responseForwarder) Flush() {
+	if !rf.wroteHeader {
+		rf.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rf.rejected.(http.Flusher); ok {
+		f.Flush()
+	}
+}
 
+// hijackWriter captures connection hijacked by websocket handshake.
+// Deadline is set on connection if timeout is provided.
+type hijackWriter struct {
+	http.ResponseWriter
+	timeout time.Duration
+	conn    net.Conn
+	// buffered input of connection read by websocket
+	inbound *bufio.Reader
+}
+
+func (hw *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := hw.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if hw.timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(hw.timeout)); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	hw.conn, hw.inbound = conn, rw.Reader
+	return conn, rw, nil
 }
@@ -2,15 +2,22 @@ package wsproxy
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -101,37 +108,1665 @@ func TestPlain(t *testing.T) {
 	wg.Wait()
 }
 
+func TestUnknownUpgrade(t *testing.T) {
+	for _, up := range []string{"h2c", "TLS/1.2", "websocket2"} {
+		t.Run(up, func(t *testing.T) {
+			ts := httptest.NewServer(New(Config{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("Handler invoked.")
+			})))
+			defer ts.Close()
+
+			req, err := http.NewRequest("GET", ts.URL, nil)
+			require.NoError(t, err)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", up)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+		})
+	}
+}
+
+func TestPassthroughUpgrades(t *testing.T) {
+	ts, wg := serve(Config{PassthroughUpgrades: true}, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "h2c", r.Header.Get("Upgrade"))
+	})
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "h2c")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	wg.Wait()
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	c := Config{AllowedOrigins: []string{"*.example.com", "https://example.org", "example.net:8443"}}
+	ts := httptest.NewServer(New(c, http.NotFoundHandler()))
+	defer ts.Close()
+
+	for origin, code := range map[string]int{
+		"http://app.example.com":      http.StatusSwitchingProtocols,
+		"http://app.example.com:8080": http.StatusSwitchingProtocols,
+		"http://a.b.example.com":      http.StatusSwitchingProtocols,
+		"https://example.org":         http.StatusSwitchingProtocols,
+		"https://example.org:8443":    http.StatusSwitchingProtocols,
+		"https://example.net:8443":    http.StatusSwitchingProtocols,
+		"http://example.com":          http.StatusForbidden,
+		"http://example.com:8080":     http.StatusForbidden,
+		"http://evilexample.com":      http.StatusForbidden,
+		"http://app.example.com.evil": http.StatusForbidden,
+		"http://example.org":          http.StatusForbidden,
+		"https://example.net":         http.StatusForbidden,
+		"https://example.net:9443":    http.StatusForbidden,
+		"http://evil.com":             http.StatusForbidden,
+	} {
+		resp := handshake(t, ts, http.Header{"Origin": {origin}})
+		resp.Body.Close()
+		assert.Equal(t, code, resp.StatusCode, origin)
+	}
+}
+
+func TestAllowedOriginsDeferUpgrade(t *testing.T) {
+	c := Config{AllowedOrigins: []string{"*.example.com"}, DeferUpgradeUntilBackendResponds: true}
+	var called int32
+	ts := httptest.NewServer(New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&called, 1)
+	})))
+	defer ts.Close()
+
+	resp := handshake(t, ts, http.Header{"Origin": {"http://evil.com"}})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Zero(t, atomic.LoadInt32(&called), "Handler called for disallowed origin.")
+}
+
+func TestServeWS(t *testing.T) {
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	wp := New(Config{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer wg.Done()
+		br := bufio.NewReader(r.Body)
+		m, err := br.ReadString('\n')
+		if assert.NoError(t, err) {
+			fmt.Fprint(w, m)
+		}
+	}))
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		wp.ServeWS(ws, ws.Request())
+	}))
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	require.NoError(t, websocket.Message.Send(ws, "hello"))
+	var m string
+	if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+		assert.Equal(t, "hello\n", m)
+	}
+	assert.Equal(t, io.EOF, websocket.Message.Receive(ws, &m))
+	wg.Wait()
+}
+
 func TestReadToken(t *testing.T) {
 	c := Config{ReadToken: true}
 	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
-		assert.Equal(t, r.Header.Get("Authorization"), "Bearer dummy token")
+		assert.Equal(t, r.Header.Get("Authorization"), "Bearer dummy token")
+		assert.Equal(t, "dummy token", r.Context().Value(TokenContextKey))
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	assert.NoError(t, websocket.Message.Send(ws, "dummy token"))
+	defer ws.Close()
+
+	wg.Wait()
+}
+
+func TestReadTokenBinary(t *testing.T) {
+	c := Config{ReadToken: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer dummy token", r.Header.Get("Authorization"))
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+	assert.NoError(t, websocket.Message.Send(ws, []byte("dummy token")))
+
+	wg.Wait()
+}
+
+func TestPublicPaths(t *testing.T) {
+	c := Config{ReadToken: true, RequireToken: true, PublicPaths: []string{"/"}}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		_, ok := r.Header["Authorization"]
+		assert.False(t, ok)
+		br := bufio.NewReader(r.Body)
+		m, err := br.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "hello\n", m)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+	assert.NoError(t, websocket.Message.Send(ws, "hello"))
+
+	wg.Wait()
+}
+
+func TestReadTokenTeardown(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		method string
+		send   bool
+		reason string
+	}{
+		{name: "immediate close", reason: closeReasonClient},
+		{name: "invalid method", method: "BAD METHOD", send: true, reason: closeReasonError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			done := make(chan Stats, 1)
+			c := Config{
+				ReadToken:        true,
+				RewriteMethodFor: func(*http.Request) string { return tc.method },
+				OnDisconnect:     func(r *http.Request, s Stats, err error) { done <- s },
+			}
+			ts := httptest.NewServer(New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("Handler invoked.")
+			})))
+			defer ts.Close()
+
+			ws := dial(t, ts)
+			if tc.send {
+				require.NoError(t, websocket.Message.Send(ws, "dummy token"))
+			}
+			require.NoError(t, ws.Close())
+
+			assert.Equal(t, tc.reason, (<-done).CloseReason)
+		})
+	}
+}
+
+func TestAuthEnvelope(t *testing.T) {
+	c := Config{ReadToken: true, AuthEnvelope: map[string]string{"token": "X-Auth-Token", "tenant": "X-Tenant"}}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "dummy", r.Header.Get("X-Auth-Token"))
+		assert.Equal(t, "acme", r.Header.Get("X-Tenant"))
+		_, ok := r.Header["Authorization"]
+		assert.False(t, ok)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+	require.NoError(t, websocket.Message.Send(ws, `{"token":"dummy","tenant":"acme","extra":1}`))
+
+	wg.Wait()
+}
+
+func TestMalformedAuthEnvelope(t *testing.T) {
+	for _, m := range []string{"dummy", `{"token":1}`, `["token"]`} {
+		t.Run(m, func(t *testing.T) {
+			c := Config{ReadToken: true, AuthEnvelope: map[string]string{"token": "X-Auth-Token"}}
+			ts := httptest.NewServer(New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("Handler invoked.")
+			})))
+			defer ts.Close()
+
+			ws := dial(t, ts)
+			defer ws.Close()
+			require.NoError(t, websocket.Message.Send(ws, m))
+
+			assert.Equal(t, ClosePolicyViolation, receiveClose(t, ws))
+		})
+	}
+}
+
+func TestEmptyToken(t *testing.T) {
+	c := Config{ReadToken: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		_, ok := r.Header["Authorization"]
+		assert.False(t, ok)
+		assert.Nil(t, r.Context().Value(TokenContextKey))
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	assert.NoError(t, websocket.Message.Send(ws, ""))
+	defer ws.Close()
+
+	wg.Wait()
+}
+
+func TestRequireToken(t *testing.T) {
+	c := Config{ReadToken: true, RequireToken: true}
+	ts := httptest.NewServer(New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler should not be invoked.")
+	})))
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	require.NoError(t, websocket.Message.Send(ws, ""))
+	assert.Equal(t, ClosePolicyViolation, receiveClose(t, ws))
+}
+
+func TestRewriteMethodFor(t *testing.T) {
+	c := Config{RewriteMethod: "PUT", AllowedMethods: []string{"GET", "POST", "PUT"}, RewriteMethodFor: func(r *http.Request) string {
+		if r.URL.Path == "/post" {
+			return "POST"
+		}
+		return ""
+	}}
+	methods := make(chan string, 2)
+	ts := httptest.NewServer(New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods <- r.Method + " " + r.URL.Path
+	})))
+	defer ts.Close()
+
+	for _, path := range []string{"/post", "/other"} {
+		ws, err := websocket.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+path, "", ts.URL)
+		require.NoError(t, err)
+		ws.Close()
+	}
+
+	assert.ElementsMatch(t, []string{"POST /post", "GET /other"}, []string{<-methods, <-methods})
+}
+
+func TestInvalidRewriteMethod(t *testing.T) {
+	c := Config{RewriteMethod: "PO ST"}
+	wp, err := NewWithError(c, http.NotFoundHandler())
+	assert.Nil(t, wp)
+	assert.EqualError(t, err, `shaxbee/go-wsproxy: invalid RewriteMethod: net/http: invalid method "PO ST"`)
+
+	assert.Panics(t, func() { New(c, http.NotFoundHandler()) })
+}
+
+func TestAllowedMethods(t *testing.T) {
+	_, err := NewWithError(Config{RewriteMethod: "DELETE"}, http.NotFoundHandler())
+	assert.EqualError(t, err, "shaxbee/go-wsproxy: RewriteMethod DELETE is not in AllowedMethods")
+
+	_, err = NewWithError(Config{RewriteMethod: "DELETE", AllowedMethods: []string{"DELETE"}}, http.NotFoundHandler())
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		method string
+		code   int
+	}{
+		{method: "POST", code: CloseNormalClosure},
+		{method: "DELETE", code: ClosePolicyViolation},
+	} {
+		t.Run(tc.method, func(t *testing.T) {
+			done := make(chan error, 1)
+			c := Config{
+				RewriteMethodFor: func(*http.Request) string { return tc.method },
+				OnDisconnect:     func(r *http.Request, s Stats, err error) { done <- err },
+			}
+			ts := httptest.NewServer(New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "POST", r.Method)
+			})))
+			defer ts.Close()
+
+			ws := dial(t, ts)
+			defer ws.Close()
+
+			assert.Equal(t, tc.code, receiveClose(t, ws))
+			if err := <-done; tc.code == CloseNormalClosure {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, ErrMethodNotAllowed))
+			}
+		})
+	}
+}
+
+func TestAllowedMethodsDeferUpgrade(t *testing.T) {
+	c := Config{
+		DeferUpgradeUntilBackendResponds: true,
+		RewriteMethodFor:                 func(*http.Request) string { return "DELETE" },
+	}
+	ts := httptest.NewServer(New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler invoked.")
+	})))
+	defer ts.Close()
+
+	resp := handshake(t, ts, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestTokenFromSubprotocol(t *testing.T) {
+	c := Config{TokenFromSubprotocol: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer dummy-token", r.Header.Get("Authorization"))
+		assert.Equal(t, "dummy-token", r.Context().Value(TokenContextKey))
+	})
+	defer ts.Close()
+
+	conf, err := websocket.NewConfig(strings.Replace(ts.URL, "http://", "ws://", 1), ts.URL)
+	require.NoError(t, err)
+	conf.Protocol = []string{"bearer", "dummy-token"}
+
+	ws, err := websocket.DialConfig(conf)
+	require.NoError(t, err)
+	defer ws.Close()
+	assert.Equal(t, []string{"bearer"}, ws.Config().Protocol)
+
+	wg.Wait()
+
+	_, err = websocket.Dial(strings.Replace(ts.URL, "http://", "ws://", 1), "", ts.URL)
+	assert.Error(t, err)
+}
+
+func TestRequiredSubprotocol(t *testing.T) {
+	c := Config{RequiredSubprotocol: "v2.api"}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {})
+	defer ts.Close()
+
+	conf, err := websocket.NewConfig(strings.Replace(ts.URL, "http://", "ws://", 1), ts.URL)
+	require.NoError(t, err)
+	conf.Protocol = []string{"v1.api", "v2.api"}
+
+	ws, err := websocket.DialConfig(conf)
+	require.NoError(t, err)
+	defer ws.Close()
+	assert.Equal(t, []string{"v2.api"}, ws.Config().Protocol)
+	wg.Wait()
+
+	for _, h := range []http.Header{nil, {"Sec-Websocket-Protocol": {"v1.api"}}} {
+		r := handshake(t, ts, h)
+		r.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	}
+}
+
+func TestRequestContentType(t *testing.T) {
+	c := Config{RequestContentType: "application/x-ndjson"}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	wg.Wait()
+}
+
+func TestRewriteMethod(t *testing.T) {
+	c := Config{RewriteMethod: "POST"}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		b, err := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Hello World!\n", string(b))
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	assert.NoError(t, websocket.Message.Send(ws, "Hello World!"))
+	ws.Close()
+
+	wg.Wait()
+}
+
+func TestFinalRecordWithoutNewline(t *testing.T) {
+	ts, wg := serve(Config{}, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "first\nlast")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	for _, expected := range []string{"first\n", "last"} {
+		var m string
+		if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+			assert.Equal(t, expected, m)
+		}
+	}
+	wg.Wait()
+}
+
+func TestRecordDelimiter(t *testing.T) {
+	c := Config{RecordDelimiter: "\r\n"}
+	expected := "first\r\nsecond\nline\r\n"
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, len(expected))
+		if _, err := io.ReadFull(r.Body, b); assert.NoError(t, err) {
+			assert.Equal(t, expected, string(b))
+		}
+		w.Write(b)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	for _, m := range []string{"first", "second\nline"} {
+		require.NoError(t, websocket.Message.Send(ws, m))
+	}
+
+	for _, expected := range []string{"first\r\n", "second\nline\r\n"} {
+		var m string
+		if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+			assert.Equal(t, expected, m)
+		}
+	}
+	wg.Wait()
+}
+
+func TestRequestClosed(t *testing.T) {
+	ts, wg := serve(Config{}, func(w http.ResponseWriter, r *http.Request) {
+		br := bufio.NewReader(r.Body)
+		_, err := br.ReadString('\n')
+		assert.NoError(t, err)
+		r.Body.Close()
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	assert.NoError(t, websocket.Message.Send(ws, "first"))
+	wg.Wait()
+	websocket.Message.Send(ws, "second")
+
+	var m string
+	assert.Equal(t, io.EOF, websocket.Message.Receive(ws, &m))
+}
+
+func TestSessionSummary(t *testing.T) {
+	c := Config{SendSessionSummary: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		br := bufio.NewReader(r.Body)
+		_, err := br.ReadString('\n')
+		assert.NoError(t, err)
+		fmt.Fprintln(w, "world")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	require.NoError(t, websocket.Message.Send(ws, "hello"))
+
+	var m string
+	require.NoError(t, websocket.Message.Receive(ws, &m))
+	assert.Equal(t, "world\n", m)
+
+	var s struct {
+		Summary Stats `json:"summary"`
+	}
+	if assert.NoError(t, websocket.JSON.Receive(ws, &s)) {
+		assert.Equal(t, int64(1), s.Summary.MessagesIn)
+		assert.Equal(t, int64(5), s.Summary.BytesIn)
+		assert.Equal(t, int64(1), s.Summary.MessagesOut)
+		assert.Equal(t, int64(6), s.Summary.BytesOut)
+		assert.Equal(t, closeReasonBackend, s.Summary.CloseReason)
+		assert.NotZero(t, s.Summary.Duration)
+	}
+	assert.Equal(t, io.EOF, websocket.Message.Receive(ws, &m))
+
+	wg.Wait()
+}
+
+func TestCloseAfterBackendDone(t *testing.T) {
+	ts, wg := serve(Config{}, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "bye")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m string
+	require.NoError(t, websocket.Message.Receive(ws, &m))
+	assert.Equal(t, "bye\n", m)
+	assert.Equal(t, io.EOF, websocket.Message.Receive(ws, &m))
+
+	wg.Wait()
+}
+
+func TestDiscardAfterBackendDone(t *testing.T) {
+	c := Config{SendSessionSummary: true, OnBackendDone: DiscardAfterBackendDone}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		br := bufio.NewReader(r.Body)
+		_, err := br.ReadString('\n')
+		assert.NoError(t, err)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	for _, m := range []string{"first", "second", "third"} {
+		require.NoError(t, websocket.Message.Send(ws, m))
+	}
+	wg.Wait()
+
+	require.NoError(t, ws.WriteClose(1000))
+
+	var s struct {
+		Summary Stats `json:"summary"`
+	}
+	if assert.NoError(t, websocket.JSON.Receive(ws, &s)) {
+		assert.Equal(t, int64(3), s.Summary.MessagesIn)
+		assert.Equal(t, closeReasonClient, s.Summary.CloseReason)
+	}
+}
+
+func TestConfigureConn(t *testing.T) {
+	c := Config{ConfigureConn: func(conn net.Conn) error {
+		tc, ok := conn.(*net.TCPConn)
+		if assert.True(t, ok) {
+			return tc.SetNoDelay(true)
+		}
+		return nil
+	}}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello World!")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m string
+	if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+		assert.Equal(t, "Hello World!\n", m)
+	}
+
+	wg.Wait()
+}
+
+func TestConfigureConnError(t *testing.T) {
+	c := Config{ConfigureConn: func(net.Conn) error {
+		return errors.New("dummy error")
+	}}
+	ts := httptest.NewServer(New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler should not be invoked.")
+	})))
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m string
+	assert.Equal(t, io.EOF, websocket.Message.Receive(ws, &m))
+}
+
+func TestRequireVersion13(t *testing.T) {
+	c := Config{RequireVersion13: true}
+	ts := httptest.NewServer(New(c, http.NotFoundHandler()))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+
+	r, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer r.Body.Close()
+
+	assert.Equal(t, http.StatusUpgradeRequired, r.StatusCode)
+	assert.Equal(t, "13", r.Header.Get("Sec-WebSocket-Version"))
+
+	ws := dial(t, ts)
+	ws.Close()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	c := Config{SendSessionSummary: true, IdleTimeout: 50 * time.Millisecond}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	// keep session active past idle timeout
+	for i := 0; i < 5; i++ {
+		require.NoError(t, websocket.Message.Send(ws, "ping"))
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	var s struct {
+		Summary Stats `json:"summary"`
+	}
+	if assert.NoError(t, websocket.JSON.Receive(ws, &s)) {
+		assert.Equal(t, int64(5), s.Summary.MessagesIn)
+		assert.Equal(t, closeReasonIdle, s.Summary.CloseReason)
+	}
+
+	wg.Wait()
+}
+
+func TestIdleTimeoutOutboundActivity(t *testing.T) {
+	c := Config{SendSessionSummary: true, IdleTimeout: 50 * time.Millisecond}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		// keep session active past idle timeout without client sending anything
+		for i := 0; i < 5; i++ {
+			fmt.Fprintln(w, `"tick"`)
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	for i := 0; i < 5; i++ {
+		var m string
+		require.NoError(t, websocket.JSON.Receive(ws, &m))
+	}
+
+	var s struct {
+		Summary Stats `json:"summary"`
+	}
+	if assert.NoError(t, websocket.JSON.Receive(ws, &s)) {
+		assert.Equal(t, int64(5), s.Summary.MessagesOut)
+		assert.Equal(t, closeReasonBackend, s.Summary.CloseReason)
+	}
+
+	wg.Wait()
+}
+
+func TestMaxSessionDuration(t *testing.T) {
+	c := Config{SendSessionSummary: true, IdleTimeout: time.Second, MaxSessionDuration: 50 * time.Millisecond}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	require.NoError(t, websocket.Message.Send(ws, "ping"))
+
+	var s struct {
+		Summary Stats `json:"summary"`
+	}
+	if assert.NoError(t, websocket.JSON.Receive(ws, &s)) {
+		assert.Equal(t, closeReasonTimeout, s.Summary.CloseReason)
+		assert.True(t, s.Summary.Duration >= 50*time.Millisecond)
+	}
+
+	wg.Wait()
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	c := Config{HandshakeTimeout: 20 * time.Millisecond}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Hello World!\n", string(b))
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+
+	// deadline must not apply once handshake completed
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, websocket.Message.Send(ws, "Hello World!"))
+	ws.Close()
+
+	wg.Wait()
+}
+
+func TestHandshakeTimeoutStalled(t *testing.T) {
+	wp := New(Config{HandshakeTimeout: 20 * time.Millisecond}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler invoked.")
+	}))
+	ts := httptest.NewUnstartedServer(wp)
+	wp.RegisterWithServer(ts.Config)
+	ts.Start()
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Client stalls once part of handshake headers is sent.
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+ts.Listener.Addr().String()+"\r\nUpgrade: websocket\r\n")
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "Stalled handshake was not aborted.")
+}
+
+func TestHandlerFor(t *testing.T) {
+	route := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, name)
+		})
+	}
+	c := Config{HandlerFor: func(r *http.Request) http.Handler {
+		switch r.URL.Path {
+		case "/foo":
+			return route("foo")
+		case "/bar":
+			return route("bar")
+		}
+		return nil
+	}}
+	ts := httptest.NewServer(New(c, nil))
+	defer ts.Close()
+
+	for _, name := range []string{"foo", "bar"} {
+		ws, err := websocket.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/"+name, "", ts.URL)
+		require.NoError(t, err)
+
+		var m string
+		if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+			assert.Equal(t, name+"\n", m)
+		}
+		ws.Close()
+	}
+
+	_, err := websocket.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/baz", "", ts.URL)
+	assert.Error(t, err)
+
+	r, err := http.Get(ts.URL + "/baz")
+	require.NoError(t, err)
+	r.Body.Close()
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+}
+
+func TestNotFoundHandler(t *testing.T) {
+	c := Config{
+		HandlerFor: func(r *http.Request) http.Handler { return nil },
+		NotFoundHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "no route for "+r.URL.Path, http.StatusNotFound)
+		}),
+	}
+	ts := httptest.NewServer(New(c, nil))
+	defer ts.Close()
+
+	for _, upgrade := range []bool{false, true} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/baz", nil)
+		require.NoError(t, err)
+		if upgrade {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		}
+		r, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, r.StatusCode)
+		assert.Equal(t, "no route for /baz\n", string(b))
+	}
+}
+
+func TestFragmentedMessage(t *testing.T) {
+	ts, wg := serve(Config{}, func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Hello World!\n", string(b))
+		}
+	})
+	defer ts.Close()
+
+	ws, conn := dialRaw(t, ts)
+	writeFrame(t, conn, false, websocket.TextFrame, "Hello ")
+	writeFrame(t, conn, false, websocket.ContinuationFrame, "World")
+	writeFrame(t, conn, true, websocket.ContinuationFrame, "!")
+	ws.Close()
+
+	wg.Wait()
+}
+
+func TestMaxFragments(t *testing.T) {
+	c := Config{MaxFragments: 2}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if assert.NoError(t, err) {
+			assert.Empty(t, b)
+		}
+	})
+	defer ts.Close()
+
+	ws, conn := dialRaw(t, ts)
+	defer ws.Close()
+
+	writeFrame(t, conn, false, websocket.TextFrame, "Hello ")
+	writeFrame(t, conn, false, websocket.ContinuationFrame, "World")
+	writeFrame(t, conn, true, websocket.ContinuationFrame, "!")
+
+	var m string
+	assert.Equal(t, io.EOF, websocket.Message.Receive(ws, &m))
+
+	wg.Wait()
+}
+
+func TestValidateUTF8(t *testing.T) {
+	c := Config{ValidateUTF8: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "héllo\n", string(b))
+		}
+	})
+	defer ts.Close()
+
+	ws, conn := dialRaw(t, ts)
+	defer ws.Close()
+
+	writeFrame(t, conn, true, websocket.TextFrame, "héllo")
+	writeFrame(t, conn, true, websocket.TextFrame, "h\xc3llo")
+	assert.Equal(t, CloseInvalidFramePayloadData, receiveClose(t, ws))
+
+	wg.Wait()
+}
+
+func TestStartSpan(t *testing.T) {
+	type spanKey struct{}
+	ended := make(chan Stats, 1)
+	c := Config{StartSpan: func(ctx context.Context, r *http.Request) (context.Context, func(Stats, error)) {
+		return context.WithValue(ctx, spanKey{}, "span"), func(s Stats, err error) {
+			assert.NoError(t, err)
+			ended <- s
+		}
+	}}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "span", r.Context().Value(spanKey{}))
+		br := bufio.NewReader(r.Body)
+		_, err := br.ReadString('\n')
+		assert.NoError(t, err)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	require.NoError(t, websocket.Message.Send(ws, "hello"))
+	wg.Wait()
+
+	s := <-ended
+	assert.Equal(t, int64(1), s.MessagesIn)
+	assert.Equal(t, int64(5), s.BytesIn)
+	assert.Equal(t, closeReasonBackend, s.CloseReason)
+}
+
+func TestUpgradeResponseHeaders(t *testing.T) {
+	c := Config{UpgradeResponseHeaders: http.Header{
+		"Cache-Control":          {"no-store"},
+		"X-Trace-Id":             {"dummy"},
+		"Sec-Websocket-Protocol": {"v1"},
+	}}
+	ts := httptest.NewServer(New(c, http.NotFoundHandler()))
+	defer ts.Close()
+
+	r := handshake(t, ts, http.Header{"Sec-WebSocket-Protocol": {"v1"}})
+	defer r.Body.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, r.StatusCode)
+	assert.Equal(t, "no-store", r.Header.Get("Cache-Control"))
+	assert.Equal(t, "dummy", r.Header.Get("X-Trace-Id"))
+	assert.Equal(t, "v1", r.Header.Get("Sec-WebSocket-Protocol"))
+}
+
+func TestBeforeUpgrade(t *testing.T) {
+	c := Config{BeforeUpgrade: func(w http.ResponseWriter, r *http.Request) error {
+		if r.Header.Get("X-Api-Key") != "secret" {
+			return &UpgradeError{Status: http.StatusUnauthorized, Body: "bad key"}
+		}
+		w.Header().Set("X-Trace-Id", "dummy")
+		return nil
+	}}
+	var called int32
+	ts := httptest.NewServer(New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&called, 1)
+	})))
+	defer ts.Close()
+
+	r := handshake(t, ts, nil)
+	b, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, r.StatusCode)
+	assert.Equal(t, "bad key\n", string(b))
+	assert.Empty(t, r.Header.Get("Upgrade"))
+	assert.Zero(t, atomic.LoadInt32(&called))
+
+	r = handshake(t, ts, http.Header{"X-Api-Key": {"secret"}})
+	defer r.Body.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, r.StatusCode)
+	assert.Equal(t, "dummy", r.Header.Get("X-Trace-Id"))
+}
+
+func TestBeforeUpgradeOrigin(t *testing.T) {
+	var called int32
+	c := Config{
+		AllowedOrigins: []string{"*.example.com"},
+		BeforeUpgrade: func(w http.ResponseWriter, r *http.Request) error {
+			atomic.AddInt32(&called, 1)
+			return nil
+		},
+	}
+	ts := httptest.NewServer(New(c, http.NotFoundHandler()))
+	defer ts.Close()
+
+	r := handshake(t, ts, http.Header{"Origin": {"http://evil.com"}})
+	r.Body.Close()
+	assert.Equal(t, http.StatusForbidden, r.StatusCode)
+	assert.Zero(t, atomic.LoadInt32(&called), "BeforeUpgrade called for disallowed origin.")
+}
+
+func TestCloseOnRedirect(t *testing.T) {
+	c := Config{HandleRedirects: CloseOnRedirect}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	assert.Equal(t, CloseRedirect, receiveClose(t, ws))
+
+	wg.Wait()
+}
+
+func TestNotifyRedirect(t *testing.T) {
+	c := Config{HandleRedirects: NotifyRedirect}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m struct {
+		Redirect string `json:"redirect"`
+	}
+	if assert.NoError(t, websocket.JSON.Receive(ws, &m)) {
+		assert.Equal(t, "/elsewhere", m.Redirect)
+	}
+	assert.Equal(t, CloseNormalClosure, receiveClose(t, ws))
+
+	wg.Wait()
+}
+
+func TestDedupeOutput(t *testing.T) {
+	c := Config{DedupeOutput: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range []string{"foo", "foo", "bar", "bar", "bar", "foo"} {
+			fmt.Fprintln(w, m)
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var recv []string
+	for {
+		var m string
+		if err := websocket.Message.Receive(ws, &m); err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		recv = append(recv, m)
+	}
+	assert.Equal(t, []string{"foo\n", "bar\n", "foo\n"}, recv)
+
+	wg.Wait()
+}
+
+func TestKeepalive(t *testing.T) {
+	c := Config{KeepaliveInterval: 50 * time.Millisecond, KeepaliveMessage: "ping"}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ {
+			fmt.Fprintln(w, "busy")
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(130 * time.Millisecond)
+		fmt.Fprintln(w, "done")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var recv []string
+	for {
+		var m string
+		if err := websocket.Message.Receive(ws, &m); err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		recv = append(recv, m)
+	}
+
+	require.True(t, len(recv) >= 12)
+	for _, m := range recv[:10] {
+		assert.Equal(t, "busy\n", m)
+	}
+	for _, m := range recv[10 : len(recv)-1] {
+		assert.Equal(t, "ping", m)
+	}
+	assert.Equal(t, "done\n", recv[len(recv)-1])
+
+	wg.Wait()
+}
+
+func TestMaxMessagesPerSession(t *testing.T) {
+	c := Config{MaxMessagesPerSession: 2, MaxMessagesCloseCode: 4000}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "first\nsecond\n", string(b))
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	for _, m := range []string{"first", "second", "third"} {
+		require.NoError(t, websocket.Message.Send(ws, m))
+	}
+	assert.Equal(t, 4000, receiveClose(t, ws))
+
+	wg.Wait()
+}
+
+func TestMaxRequestBodyBytes(t *testing.T) {
+	c := Config{MaxRequestBodyBytes: 10}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "first\n", string(b))
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	for _, m := range []string{"first", "second"} {
+		require.NoError(t, websocket.Message.Send(ws, m))
+	}
+	assert.Equal(t, CloseMessageTooBig, receiveClose(t, ws))
+
+	wg.Wait()
+}
+
+func TestCloseTimeout(t *testing.T) {
+	done := make(chan struct{})
+	c := Config{
+		MaxSessionDuration: 50 * time.Millisecond,
+		CloseTimeout:       100 * time.Millisecond,
+		OnDisconnect:       func(*http.Request, Stats, error) { close(done) },
+	}
+	msg := strings.Repeat("x", 1024)
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		for {
+			if _, err := fmt.Fprintln(w, msg); err != nil {
+				return
+			}
+		}
+	})
+	defer ts.Close()
+
+	// Client never reads.
+	_, conn := dialRaw(t, ts)
+	defer conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Teardown did not complete.")
+	}
+	wg.Wait()
+}
+
+func TestCloseHandshakeTimeout(t *testing.T) {
+	c := Config{CloseHandshakeTimeout: time.Second}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {})
+	defer ts.Close()
+
+	ws, conn := dialRaw(t, ts)
+	defer conn.Close()
+	assert.Equal(t, CloseNormalClosure, receiveClose(t, ws))
+
+	// Connection is kept open until close is acknowledged.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err := conn.Read(make([]byte, 1))
+	var ne net.Error
+	require.True(t, errors.As(err, &ne) && ne.Timeout(), "Connection closed before close was acknowledged: %v", err)
+
+	writeFrame(t, conn, true, websocket.CloseFrame, "\x03\xe8")
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	wg.Wait()
+}
+
+func TestCloseHandshakeTimeoutExpired(t *testing.T) {
+	c := Config{CloseHandshakeTimeout: 50 * time.Millisecond}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {})
+	defer ts.Close()
+
+	ws, conn := dialRaw(t, ts)
+	defer conn.Close()
+	assert.Equal(t, CloseNormalClosure, receiveClose(t, ws))
+
+	// Client never acknowledges close.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	wg.Wait()
+}
+
+func TestPauseResume(t *testing.T) {
+	c := Config{PauseMessage: "pause", ResumeMessage: "resume", MaxPauseBuffer: 1024}
+	written := make(chan struct{})
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		br := bufio.NewReader(r.Body)
+		m, err := br.ReadString('\n')
+		if assert.NoError(t, err) {
+			fmt.Fprint(w, m)
+		}
+		close(written)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	require.NoError(t, websocket.Message.Send(ws, "pause"))
+	require.NoError(t, websocket.Message.Send(ws, "hello"))
+	<-written
+
+	var m string
+	require.NoError(t, ws.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	assert.Error(t, websocket.Message.Receive(ws, &m), "Message received while paused.")
+	require.NoError(t, ws.SetReadDeadline(time.Time{}))
+
+	require.NoError(t, websocket.Message.Send(ws, "resume"))
+	if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+		assert.Equal(t, "hello\n", m)
+	}
+	wg.Wait()
+}
+
+func TestMaxFramesInFlight(t *testing.T) {
+	// Simulated latency holds writes to websocket.
+	c := Config{MaxFramesInFlight: 2, ChaosMode: true, SimulatedLatency: 200 * time.Millisecond}
+	var written int32
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range []string{"a", "b", "c", "d"} {
+			if _, err := fmt.Fprintln(w, m); err != nil {
+				return
+			}
+			atomic.AddInt32(&written, 1)
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	// First record is being sent and second is read ahead, backend blocks on third.
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&written) == 2 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&written), "Backend not blocked by in-flight limit.")
+
+	for _, exp := range []string{"a\n", "b\n", "c\n", "d\n"} {
+		var m string
+		if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+			assert.Equal(t, exp, m)
+		}
+	}
+	wg.Wait()
+}
+
+func TestMaxFramesInFlightPaused(t *testing.T) {
+	c := Config{PauseMessage: "pause", ResumeMessage: "resume", MaxPauseBuffer: 1024, MaxFramesInFlight: 2}
+	var written int32
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		// pause message is handled before next message is forwarded
+		if _, err := bufio.NewReader(r.Body).ReadString('\n'); !assert.NoError(t, err) {
+			return
+		}
+		for _, m := range []string{"a", "b", "c", "d"} {
+			if _, err := fmt.Fprintln(w, m); err != nil {
+				return
+			}
+			atomic.AddInt32(&written, 1)
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	require.NoError(t, websocket.Message.Send(ws, "pause"))
+	require.NoError(t, websocket.Message.Send(ws, "go"))
+
+	// Buffered records count against limit, backend blocks on third.
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&written) == 2 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&written), "Backend not blocked by in-flight limit.")
+
+	require.NoError(t, websocket.Message.Send(ws, "resume"))
+	for _, exp := range []string{"a\n", "b\n", "c\n", "d\n"} {
+		var m string
+		if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+			assert.Equal(t, exp, m)
+		}
+	}
+	wg.Wait()
+}
+
+func TestMaxFramesInFlightMultiplex(t *testing.T) {
+	_, err := NewWithError(Config{MaxFramesInFlight: 2, Multiplex: true}, http.NotFoundHandler())
+	assert.Error(t, err)
+}
+
+func TestMaxSessionBufferBytes(t *testing.T) {
+	c := Config{PauseMessage: "pause", ResumeMessage: "resume", MaxPauseBuffer: 1024, MaxSessionBufferBytes: 16}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		// pause message is handled before next message is forwarded
+		if _, err := bufio.NewReader(r.Body).ReadString('\n'); !assert.NoError(t, err) {
+			return
+		}
+		for r.Context().Err() == nil {
+			if _, err := fmt.Fprintln(w, "hello"); err != nil {
+				return
+			}
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	require.NoError(t, websocket.Message.Send(ws, "pause"))
+	require.NoError(t, websocket.Message.Send(ws, "hello"))
+
+	assert.Equal(t, CloseMessageTooBig, receiveClose(t, ws))
+	wg.Wait()
+}
+
+func TestUnsolicitedPongInterval(t *testing.T) {
+	c := Config{UnsolicitedPongInterval: 10 * time.Millisecond}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	for pongs := 0; pongs < 3; {
+		frame, err := ws.NewFrameReader()
+		require.NoError(t, err)
+		if frame.PayloadType() == websocket.PongFrame {
+			pongs++
+		}
+		_, err = io.Copy(ioutil.Discard, frame)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, ws.Close())
+	wg.Wait()
+}
+
+func TestClientAborted(t *testing.T) {
+	type result struct {
+		stats Stats
+		err   error
+	}
+	done := make(chan result, 1)
+	c := Config{OnDisconnect: func(r *http.Request, s Stats, err error) { done <- result{s, err} }}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	})
+	defer ts.Close()
+
+	ws, conn := dialRaw(t, ts)
+	require.NoError(t, websocket.Message.Send(ws, "hello"))
+	// Discard unsent data and reset connection on close.
+	require.NoError(t, conn.(*net.TCPConn).SetLinger(0))
+	require.NoError(t, conn.Close())
+
+	r := <-done
+	assert.True(t, errors.Is(r.err, ErrClientAborted), "Unexpected error: %v", r.err)
+	assert.Equal(t, closeReasonAborted, r.stats.CloseReason)
+	assert.Equal(t, CloseAbnormalClosure, r.stats.CloseCode)
+
+	wg.Wait()
+}
+
+func TestMaxConcurrentHandlers(t *testing.T) {
+	const max = 2
+	var mu sync.Mutex
+	running, peak := 0, 0
+	started := make(chan struct{}, max)
+	release := make(chan struct{})
+	ts := httptest.NewServer(New(Config{MaxConcurrentHandlers: max}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		started <- struct{}{}
+
+		<-release
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})))
+	defer ts.Close()
+
+	for i := 0; i < max; i++ {
+		ws := dial(t, ts)
+		defer ws.Close()
+		<-started
+	}
+
+	// Further connections are rejected while all handlers are running.
+	ws := dial(t, ts)
+	assert.Equal(t, CloseTryAgainLater, receiveClose(t, ws))
+	ws.Close()
+
+	close(release)
+	require.Eventually(t, func() bool {
+		ws := dial(t, ts)
+		defer ws.Close()
+		var m string
+		return websocket.Message.Receive(ws, &m) == io.EOF
+	}, time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, max, peak)
+}
+
+func TestMaxPayloadBytes(t *testing.T) {
+	c := Config{MaxPayloadBytes: 8}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "short\n", string(b))
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	for _, m := range []string{"short", "too long message"} {
+		require.NoError(t, websocket.Message.Send(ws, m))
+	}
+	assert.Equal(t, CloseMessageTooBig, receiveClose(t, ws))
+
+	wg.Wait()
+}
+
+func TestOnDisconnect(t *testing.T) {
+	done := make(chan Stats, 1)
+	c := Config{OnDisconnect: func(r *http.Request, s Stats, err error) {
+		assert.NoError(t, err)
+		done <- s
+	}}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	})
+	defer ts.Close()
+
+	ws, conn := dialRaw(t, ts)
+	defer ws.Close()
+
+	require.NoError(t, websocket.Message.Send(ws, "hello"))
+	writeFrame(t, conn, true, websocket.CloseFrame, "\x0f\xa1bye")
+
+	s := <-done
+	assert.Equal(t, closeReasonClient, s.CloseReason)
+	assert.Equal(t, 4001, s.CloseCode)
+	assert.Equal(t, "bye", s.CloseText)
+	assert.Equal(t, int64(1), s.MessagesIn)
+
+	wg.Wait()
+}
+
+func TestNoOutputThreshold(t *testing.T) {
+	metrics := make(chan Metric, 1)
+	c := Config{NoOutputThreshold: 20 * time.Millisecond, Metrics: func(m Metric) {
+		if m.Name == MetricNoOutput {
+			metrics <- m
+		}
+	}}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintln(w, "late")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m string
+	if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+		assert.Equal(t, "late\n", m)
+	}
+	wg.Wait()
+
+	select {
+	case m := <-metrics:
+		assert.Equal(t, Metric{Name: MetricNoOutput, Value: 1, Labels: map[string]string{LabelPath: "/"}}, m)
+	default:
+		t.Error("Metric was not reported.")
+	}
+}
+
+func TestWriteBlocked(t *testing.T) {
+	const records = 256
+	blocked := make(chan float64, 1)
+	c := Config{
+		LengthPrefixed: true,
+		Metrics: func(m Metric) {
+			if m.Name == MetricWriteBlocked {
+				blocked <- m.Value
+			}
+		},
+	}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 64*1024)
+		for i := 0; i < records; i++ {
+			if err := WriteRecord(w, b); err != nil {
+				return
+			}
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	// slow client applies backpressure
+	time.Sleep(200 * time.Millisecond)
+	for i := 0; i < records; i++ {
+		var b []byte
+		require.NoError(t, websocket.Message.Receive(ws, &b))
+	}
+	wg.Wait()
+	require.NoError(t, ws.Close())
+
+	assert.True(t, <-blocked >= 0.1, "Blocked time not reported.")
+}
+
+func TestBackendStatusMetric(t *testing.T) {
+	metrics := make(chan Metric, 1)
+	c := Config{Metrics: func(m Metric) {
+		if m.Name == MetricBackendStatus {
+			metrics <- m
+		}
+	}}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+	wg.Wait()
+
+	assert.Equal(t, Metric{Name: MetricBackendStatus, Value: 1, Labels: map[string]string{LabelPath: "/", LabelStatus: "503"}}, <-metrics)
+}
+
+func TestDeferUpgradeUntilBackendResponds(t *testing.T) {
+	c := Config{DeferUpgradeUntilBackendResponds: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		br := bufio.NewReader(r.Body)
+		m, err := br.ReadString('\n')
+		if assert.NoError(t, err) {
+			fmt.Fprint(w, m)
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	require.NoError(t, websocket.Message.Send(ws, "hello"))
+	var m string
+	if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+		assert.Equal(t, "hello\n", m)
+	}
+	wg.Wait()
+}
+
+func TestDeferUpgradeRejected(t *testing.T) {
+	ended := make(chan Stats, 1)
+	c := Config{
+		DeferUpgradeUntilBackendResponds: true,
+		StartSpan: func(ctx context.Context, r *http.Request) (context.Context, func(Stats, error)) {
+			return ctx, func(s Stats, err error) {
+				assert.NoError(t, err)
+				ended <- s
+			}
+		},
+	}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Reason", "denied")
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+	defer ts.Close()
+
+	resp := handshake(t, ts, nil)
+	defer resp.Body.Close()
+	wg.Wait()
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "denied", resp.Header.Get("X-Reason"))
+	b, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "forbidden\n", string(b))
+	assert.Equal(t, closeReasonRejected, (<-ended).CloseReason)
+}
+
+func TestDeferUpgradeHandshakeFailed(t *testing.T) {
+	c := Config{DeferUpgradeUntilBackendResponds: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		// Response is streamed until request is cancelled.
+		for r.Context().Err() == nil {
+			fmt.Fprintln(w, "hello")
+			time.Sleep(time.Millisecond)
+		}
+	})
+	defer ts.Close()
+
+	// Handshake fails without Sec-WebSocket-Key after backend accepted upgrade.
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Origin", ts.URL)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler was not cancelled.")
+	}
+}
+
+func TestDeferUpgradeReadToken(t *testing.T) {
+	_, err := NewWithError(Config{DeferUpgradeUntilBackendResponds: true, ReadToken: true}, http.NotFoundHandler())
+	assert.Error(t, err)
+}
+
+func TestRequestID(t *testing.T) {
+	c := Config{RequestIDHeader: "X-Request-Id", GenerateRequestID: func() string { return "generated" }, SendSessionSummary: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "generated", r.Header.Get("X-Request-Id"))
 	})
 	defer ts.Close()
 
 	ws := dial(t, ts)
-	assert.NoError(t, websocket.Message.Send(ws, "dummy token"))
 	defer ws.Close()
-
 	wg.Wait()
+
+	var m struct {
+		Summary Stats `json:"summary"`
+	}
+	if assert.NoError(t, websocket.JSON.Receive(ws, &m)) {
+		assert.Equal(t, "generated", m.Summary.RequestID)
+	}
 }
 
-func TestRewriteMethod(t *testing.T) {
-	c := Config{RewriteMethod: "POST"}
+func TestRequestIDPropagated(t *testing.T) {
+	c := Config{RequestIDHeader: "X-Request-Id"}
 	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
-		assert.Equal(t, "POST", r.Method)
-		b, err := ioutil.ReadAll(r.Body)
-		defer r.Body.Close()
-
-		if assert.NoError(t, err) {
-			assert.Equal(t, "Hello World!\n", string(b))
-		}
+		assert.Equal(t, "incoming", r.Header.Get("X-Request-Id"))
 	})
 	defer ts.Close()
 
-	ws := dial(t, ts)
-	assert.NoError(t, websocket.Message.Send(ws, "Hello World!"))
-	ws.Close()
-
+	resp := handshake(t, ts, http.Header{"X-Request-Id": {"incoming"}})
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
 	wg.Wait()
 }
 
@@ -152,6 +1787,92 @@ func dial(t *testing.T, ts *httptest.Server) *websocket.Conn {
 	return ws
 }
 
+// dialRaw establishes websocket connection exposing underlying network connection.
+func dialRaw(t *testing.T, ts *httptest.Server) (*websocket.Conn, net.Conn) {
+	conf, err := websocket.NewConfig(strings.Replace(ts.URL, "http://", "ws://", 1), ts.URL)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", conf.Location.Host)
+	require.NoError(t, err)
+
+	ws, err := websocket.NewClient(conf, conn)
+	require.NoError(t, err, "Failed to establish websocket connection.")
+	return ws, conn
+}
+
+// handshake performs websocket handshake with additional headers and returns response.
+// Connection is closed along with response body.
+func handshake(t *testing.T, ts *httptest.Server, h http.Header) *http.Response {
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	require.NoError(t, err)
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	if req.Header.Get("Origin") == "" {
+		req.Header.Set("Origin", ts.URL)
+	}
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if req.Header.Get("Sec-WebSocket-Version") == "" {
+		req.Header.Set("Sec-WebSocket-Version", "13")
+	}
+	require.NoError(t, req.Write(conn))
+
+	r, err := http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	r.Body = connBody{ReadCloser: r.Body, conn: conn}
+	return r
+}
+
+// connBody closes connection along with response body.
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b connBody) Close() error {
+	b.ReadCloser.Close()
+	return b.conn.Close()
+}
+
+// receiveClose discards messages until close frame is received and returns its status code.
+func receiveClose(t *testing.T, ws *websocket.Conn) int {
+	for {
+		frame, err := ws.NewFrameReader()
+		require.NoError(t, err)
+
+		if frame.PayloadType() == websocket.CloseFrame {
+			b, err := ioutil.ReadAll(frame)
+			require.NoError(t, err)
+			require.True(t, len(b) >= 2, "Close frame without status code.")
+			return int(binary.BigEndian.Uint16(b))
+		}
+
+		frame, err = ws.HandleFrame(frame)
+		require.NoError(t, err)
+		if frame != nil {
+			_, err = io.Copy(ioutil.Discard, frame)
+			require.NoError(t, err)
+		}
+	}
+}
+
+// writeFrame writes single masked client frame.
+func writeFrame(t *testing.T, w io.Writer, fin bool, opcode byte, payload string) {
+	require.True(t, len(payload) < 126)
+
+	h := []byte{opcode, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+	if fin {
+		h[0] |= 0x80
+	}
+	_, err := w.Write(append(h, payload...))
+	require.NoError(t, err)
+}
+
 func read(br *bufio.Reader, m *Message) error {
 	b, err := br.ReadBytes('\n')
 	if err != nil {
@@ -169,3 +1890,485 @@ func write(bw *bufio.Writer, m *Message) error {
 	bw.WriteRune('\n')
 	return bw.Flush()
 }
+
+// BenchmarkProxyThroughput measures round trip of 1KiB messages through echo backend.
+// Reusing read buffers and sending frames without string conversion
+// reduced allocations from 12448 B/op, 33 allocs/op to 5776 B/op, 26 allocs/op.
+func BenchmarkProxyThroughput(b *testing.B) {
+	ts := httptest.NewServer(New(Config{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})))
+	defer ts.Close()
+
+	ws, err := websocket.Dial(strings.Replace(ts.URL, "http://", "ws://", 1), "", ts.URL)
+	require.NoError(b, err)
+	defer ws.Close()
+
+	payload := strings.Repeat("x", 1023)
+	b.SetBytes(int64(len(payload) + 1))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var m string
+	for i := 0; i < b.N; i++ {
+		if err := websocket.Message.Send(ws, payload); err != nil {
+			b.Fatal(err)
+		}
+		if err := websocket.Message.Receive(ws, &m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestErrorHeader(t *testing.T) {
+	c := Config{ErrorHeader: "X-Error"}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Error", "upstream unavailable")
+		fmt.Fprintln(w, "discarded")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m struct {
+		Error string `json:"error"`
+	}
+	if assert.NoError(t, websocket.JSON.Receive(ws, &m)) {
+		assert.Equal(t, "upstream unavailable", m.Error)
+	}
+	assert.Equal(t, CloseInternalServerErr, receiveClose(t, ws))
+
+	wg.Wait()
+}
+
+func TestTeardownWaitsForHandler(t *testing.T) {
+	finished := make(chan struct{})
+	done := make(chan bool, 1)
+	c := Config{OnDisconnect: func(*http.Request, Stats, error) {
+		select {
+		case <-finished:
+			done <- true
+		default:
+			done <- false
+		}
+	}}
+	ts, _ := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		defer close(finished)
+
+		io.Copy(ioutil.Discard, r.Body)
+		time.Sleep(50 * time.Millisecond)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	require.NoError(t, websocket.Message.Send(ws, "foo"))
+	ws.Close()
+
+	assert.True(t, <-done, "handler still running when session ended")
+}
+
+func TestMaxHandshakeHeaderBytes(t *testing.T) {
+	c := Config{MaxHandshakeHeaderBytes: 1024}
+	ts := httptest.NewServer(New(c, http.NotFoundHandler()))
+	defer ts.Close()
+
+	r := handshake(t, ts, nil)
+	r.Body.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, r.StatusCode)
+
+	h := http.Header{}
+	for i := 0; i < 32; i++ {
+		h.Set(fmt.Sprintf("X-Padding-%d", i), strings.Repeat("x", 64))
+	}
+	r = handshake(t, ts, h)
+	r.Body.Close()
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, r.StatusCode)
+}
+
+func TestOnDisposition(t *testing.T) {
+	upgraded := make(chan bool, 1)
+	c := Config{OnDisposition: func(r *http.Request, u bool) { upgraded <- u }}
+	ts := httptest.NewServer(New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer ts.Close()
+
+	r, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	r.Body.Close()
+	assert.False(t, <-upgraded)
+
+	ws := dial(t, ts)
+	defer ws.Close()
+	assert.True(t, <-upgraded)
+}
+
+func TestSubprotocolHeader(t *testing.T) {
+	c := Config{SubprotocolHeader: "X-WS-Protocol"}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "v2", r.Header.Get("X-WS-Protocol"))
+	})
+	defer ts.Close()
+
+	conf, err := websocket.NewConfig(strings.Replace(ts.URL, "http://", "ws://", 1), ts.URL)
+	require.NoError(t, err)
+	conf.Protocol = []string{"v2"}
+
+	ws, err := websocket.DialConfig(conf)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	wg.Wait()
+}
+
+func TestCloseReasonHeader(t *testing.T) {
+	c := Config{CloseReasonHeader: "X-Error-Message"}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Error-Message", "missing id")
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	_, _, err := receive(ws, new(bytes.Buffer), 0)
+	if ce, ok := err.(*CloseError); assert.True(t, ok, "Expected close error, got %v.", err) {
+		assert.Equal(t, CloseNormalClosure, ce.Code)
+		assert.Equal(t, "400 Bad Request: missing id", ce.Text)
+	}
+
+	wg.Wait()
+}
+
+func TestCloseCodeHeader(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		code   int
+	}{
+		{header: "4001", code: 4001},
+		{header: "1006", code: CloseNormalClosure},
+		{header: "invalid", code: CloseNormalClosure},
+	} {
+		t.Run(tc.header, func(t *testing.T) {
+			c := Config{CloseCodeHeader: "X-WS-Close-Code"}
+			ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-WS-Close-Code", tc.header)
+				fmt.Fprintln(w, "bye")
+			})
+			defer ts.Close()
+
+			ws := dial(t, ts)
+			defer ws.Close()
+
+			assert.Equal(t, tc.code, receiveClose(t, ws))
+
+			wg.Wait()
+		})
+	}
+}
+
+func TestConnectionLabels(t *testing.T) {
+	metrics := make(chan Metric, 1)
+	c := Config{
+		NoOutputThreshold: 20 * time.Millisecond,
+		Metrics: func(m Metric) {
+			if m.Name == MetricNoOutput {
+				metrics <- m
+			}
+		},
+		ConnectionLabels: func(r *http.Request) map[string]string {
+			return map[string]string{"tenant": r.URL.Query().Get("tenant"), LabelPath: "ignored"}
+		},
+	}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	})
+	defer ts.Close()
+
+	ws, err := websocket.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/?tenant=acme", "", ts.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+	wg.Wait()
+
+	m := <-metrics
+	assert.Equal(t, map[string]string{LabelPath: "/", "tenant": "acme"}, m.Labels)
+}
+
+func TestForwardOriginalPath(t *testing.T) {
+	c := Config{ForwardOriginalPath: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/events?since=42", r.Header.Get("X-Original-URI"))
+	})
+	defer ts.Close()
+
+	ws, err := websocket.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/events?since=42", "", ts.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	wg.Wait()
+}
+
+func TestRequestContextCanceled(t *testing.T) {
+	started := make(chan struct{})
+	ts, wg := serve(Config{}, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+			t.Error("Request context not canceled.")
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	<-started
+	ws.Close()
+
+	wg.Wait()
+}
+
+func TestFrameTypeFromContentType(t *testing.T) {
+	for ct, pt := range map[string]byte{
+		"application/octet-stream":        websocket.BinaryFrame,
+		"application/json; charset=utf-8": websocket.TextFrame,
+		"text/plain":                      websocket.TextFrame,
+	} {
+		t.Run(ct, func(t *testing.T) {
+			c := Config{FrameTypeFromContentType: true}
+			ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", ct)
+				fmt.Fprintln(w, "foo")
+			})
+			defer ts.Close()
+
+			ws := dial(t, ts)
+			defer ws.Close()
+
+			frame, err := ws.NewFrameReader()
+			require.NoError(t, err)
+			assert.Equal(t, pt, frame.PayloadType())
+			b, err := ioutil.ReadAll(frame)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "foo\n", string(b))
+			}
+
+			wg.Wait()
+		})
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	done := make(chan error, 1)
+	c := Config{
+		ReadToken:            true,
+		AuthFailureCloseCode: 4401,
+		ValidateToken: func(r *http.Request, tok string) error {
+			if tok != "valid" {
+				return errors.New("dummy error")
+			}
+			return nil
+		},
+		OnDisconnect: func(r *http.Request, s Stats, err error) { done <- err },
+	}
+	ts := httptest.NewServer(New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler invoked.")
+	})))
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+	require.NoError(t, websocket.Message.Send(ws, "invalid"))
+
+	assert.Equal(t, 4401, receiveClose(t, ws))
+	assert.True(t, errors.Is(<-done, ErrTokenRejected))
+}
+
+func TestValidateTokenDeferUpgrade(t *testing.T) {
+	c := Config{
+		DeferUpgradeUntilBackendResponds: true,
+		TokenFromSubprotocol:             true,
+		ValidateToken: func(*http.Request, string) error {
+			return errors.New("dummy error")
+		},
+	}
+	ts := httptest.NewServer(New(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler invoked.")
+	})))
+	defer ts.Close()
+
+	r := handshake(t, ts, http.Header{"Sec-Websocket-Protocol": {"bearer, dummy-token"}})
+	r.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, r.StatusCode)
+}
+
+func TestEchoMode(t *testing.T) {
+	ts := httptest.NewServer(New(Config{EchoMode: true}, nil))
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	for _, m := range []string{"foo", "bar"} {
+		require.NoError(t, websocket.Message.Send(ws, m))
+
+		var r string
+		if assert.NoError(t, websocket.Message.Receive(ws, &r)) {
+			assert.Equal(t, m+"\n", r)
+		}
+	}
+}
+
+func TestOnFrameTypeMismatch(t *testing.T) {
+	for _, p := range []FrameTypePolicy{ConvertMismatchedFrames, DropMismatchedFrames, CloseOnMismatchedFrame} {
+		t.Run(fmt.Sprint(p), func(t *testing.T) {
+			received := make(chan string, 2)
+			c := Config{OnFrameTypeMismatch: p}
+			ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+				br := bufio.NewReader(r.Body)
+				for {
+					m, err := br.ReadString('\n')
+					if err != nil {
+						close(received)
+						return
+					}
+					received <- m
+				}
+			})
+			defer ts.Close()
+
+			ws := dial(t, ts)
+			defer ws.Close()
+
+			require.NoError(t, websocket.Message.Send(ws, []byte("binary")))
+			require.NoError(t, websocket.Message.Send(ws, "text"))
+
+			switch p {
+			case ConvertMismatchedFrames:
+				assert.Equal(t, "binary\n", <-received)
+				assert.Equal(t, "text\n", <-received)
+			case DropMismatchedFrames:
+				assert.Equal(t, "text\n", <-received)
+			case CloseOnMismatchedFrame:
+				assert.Equal(t, CloseUnsupportedData, receiveClose(t, ws))
+				_, ok := <-received
+				assert.False(t, ok)
+			}
+			ws.Close()
+
+			wg.Wait()
+		})
+	}
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	done := make(chan error, 1)
+	c := Config{
+		FirstByteTimeout:          20 * time.Millisecond,
+		FirstByteTimeoutCloseCode: CloseTryAgainLater,
+		OnDisconnect:              func(r *http.Request, s Stats, err error) { done <- err },
+	}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+			t.Error("Request not canceled.")
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	assert.Equal(t, CloseTryAgainLater, receiveClose(t, ws))
+	assert.True(t, errors.Is(<-done, ErrBackendFailed))
+
+	wg.Wait()
+}
+
+func TestForwardSetCookie(t *testing.T) {
+	c := Config{ForwardSetCookie: true}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "dummy", HttpOnly: true})
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+		fmt.Fprintln(w, "foo")
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	var m struct {
+		SetCookie []string `json:"set_cookie"`
+	}
+	if assert.NoError(t, websocket.JSON.Receive(ws, &m)) {
+		assert.Equal(t, []string{"session=dummy; HttpOnly", "theme=dark"}, m.SetCookie)
+	}
+	var r string
+	if assert.NoError(t, websocket.Message.Receive(ws, &r)) {
+		assert.Equal(t, "foo\n", r)
+	}
+
+	wg.Wait()
+}
+
+func TestOnRequest(t *testing.T) {
+	c := Config{OnRequest: func(r *http.Request) {
+		r.Header.Set("X-Forwarded-Method", r.Method)
+	}}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "GET", r.Header.Get("X-Forwarded-Method"))
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	wg.Wait()
+}
+
+func TestFirstFrameTimeout(t *testing.T) {
+	c := Config{ReadToken: true, FirstFrameTimeout: 50 * time.Millisecond}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+	require.NoError(t, websocket.Message.Send(ws, "dummy token"))
+
+	assert.Equal(t, ClosePolicyViolation, receiveClose(t, ws))
+	wg.Wait()
+}
+
+func TestFirstFrameTimeoutStopped(t *testing.T) {
+	c := Config{FirstFrameTimeout: 20 * time.Millisecond}
+	ts, wg := serve(c, func(w http.ResponseWriter, r *http.Request) {
+		br := bufio.NewReader(r.Body)
+		for i := 0; i < 2; i++ {
+			m, err := br.ReadString('\n')
+			if !assert.NoError(t, err) {
+				return
+			}
+			io.WriteString(w, m)
+		}
+	})
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+
+	// session is kept alive once client sent message
+	require.NoError(t, websocket.Message.Send(ws, "foo"))
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, websocket.Message.Send(ws, "bar"))
+
+	for _, exp := range []string{"foo\n", "bar\n"} {
+		var m string
+		if assert.NoError(t, websocket.Message.Receive(ws, &m)) {
+			assert.Equal(t, exp, m)
+		}
+	}
+
+	wg.Wait()
+}